@@ -0,0 +1,80 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// newBackendTransport returns the transport for requests to the Grafana
+// backend, configured per flags.
+func newBackendTransport() *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	tr.DialContext = dialer.DialContext
+	if addr := *backendDialAddr; addr != "" {
+		// Requests still name --backend-addr; only the dial differs.
+		tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	if *backendProxyProtocol != 0 {
+		useProxyProtocol(tr, *backendProxyProtocol)
+	}
+	tr.ResponseHeaderTimeout = *backendHeaderTimeout
+	tr.MaxIdleConns = *backendMaxIdle
+	tr.MaxIdleConnsPerHost = *backendIdlePerHost
+	tr.MaxConnsPerHost = *backendMaxConns
+	return tr
+}
+
+// statusClientClosedRequest is nginx's non-standard status for requests
+// whose client went away before the response was ready. It's only ever
+// logged, since there's no one left to send it to.
+const statusClientClosedRequest = 499
+
+// retryAfterSeconds is the Retry-After sent with 503s for an unavailable
+// backend.
+const retryAfterSeconds = "10"
+
+// backendErrorStatus returns the HTTP status to reply with when proxying
+// r to the backend fails with err: 503 Service Unavailable if the
+// backend timed out or couldn't be reached, statusClientClosedRequest if
+// the client gave up, and 502 Bad Gateway otherwise.
+func backendErrorStatus(r *http.Request, err error) int {
+	if errors.Is(err, context.Canceled) || r.Context().Err() != nil {
+		return statusClientClosedRequest
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return http.StatusServiceUnavailable
+	}
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "dial" {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// backendErrorHandler is a ReverseProxy.ErrorHandler that replies with
+// the status from backendErrorStatus, rather than always 502.
+func backendErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	status := backendErrorStatus(r, err)
+	log.Printf("request %s: proxy error (%d): %v", getRequestInfo(r.Context()).id, status, err)
+	if status == statusClientClosedRequest {
+		return
+	}
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", retryAfterSeconds)
+	}
+	w.WriteHeader(status)
+}
@@ -0,0 +1,181 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBackendErrorStatus(t *testing.T) {
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want int
+	}{
+		{"dial", context.Background(), &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, 503},
+		{"timeout", context.Background(), fmt.Errorf("wrapped: %w", os.ErrDeadlineExceeded), 503},
+		{"client-gone", canceledCtx, context.Canceled, statusClientClosedRequest},
+		{"other", context.Background(), errors.New("malformed HTTP response"), 502},
+		{"read", context.Background(), &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset")}, 502},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil).WithContext(tt.ctx)
+			if got := backendErrorStatus(r, tt.err); got != tt.want {
+				t.Errorf("got %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackendErrorHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	backendErrorHandler(rec, httptest.NewRequest("GET", "/", nil), &net.OpError{Op: "dial", Err: errors.New("refused")})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d; want 503", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != retryAfterSeconds {
+		t.Errorf("Retry-After = %q; want %q", got, retryAfterSeconds)
+	}
+}
+
+func TestBackendDialAddr(t *testing.T) {
+	hostc := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hostc <- r.Host
+	}))
+	defer backend.Close()
+
+	defer func(v string) { *backendDialAddr = v }(*backendDialAddr)
+	*backendDialAddr = backend.Listener.Addr().String()
+
+	req := httptest.NewRequest("GET", "http://grafana.invalid:3000/", nil)
+	req.RequestURI = ""
+	res, err := newBackendTransport().RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got, want := <-hostc, "grafana.invalid:3000"; got != want {
+		t.Errorf("backend got Host %q; want %q", got, want)
+	}
+}
+
+func TestBackendTransportPoolLimits(t *testing.T) {
+	defer func(c, i, p int) { *backendMaxConns, *backendMaxIdle, *backendIdlePerHost = c, i, p }(*backendMaxConns, *backendMaxIdle, *backendIdlePerHost)
+
+	tr := newBackendTransport()
+	if tr.MaxConnsPerHost != 0 || tr.MaxIdleConns != 100 || tr.MaxIdleConnsPerHost != http.DefaultMaxIdleConnsPerHost {
+		t.Errorf("default limits %d/%d/%d; want Go's defaults", tr.MaxConnsPerHost, tr.MaxIdleConns, tr.MaxIdleConnsPerHost)
+	}
+
+	*backendMaxConns, *backendMaxIdle, *backendIdlePerHost = 8, 10, 4
+	tr = newBackendTransport()
+	if tr.MaxConnsPerHost != 8 || tr.MaxIdleConns != 10 || tr.MaxIdleConnsPerHost != 4 {
+		t.Errorf("limits %d/%d/%d; want 8/10/4", tr.MaxConnsPerHost, tr.MaxIdleConns, tr.MaxIdleConnsPerHost)
+	}
+}
+
+func TestBackendTargetSwitch(t *testing.T) {
+	newBackend := func(name string) *url.URL {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(s.Close)
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	target := newBackendTarget(newBackend("old"))
+	h, err := newHandler(target, fakeWhoIs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	body := func() string {
+		res, err := http.Get(proxy.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	if got := body(); got != "old" {
+		t.Fatalf("before switch, got %q; want old", got)
+	}
+	target.set(newBackend("new"))
+	if got := body(); got != "new" {
+		t.Errorf("after switch, got %q; want new", got)
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	defer func(v time.Duration) { *flushInterval = v }(*flushInterval)
+	*flushInterval = -1
+
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		io.WriteString(w, "hello")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "world")
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := newHandler(newBackendTarget(u), fakeWhoIs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+	// Let the backend finish before the servers are closed.
+	defer close(release)
+
+	// The backend waits for us before finishing the response, so we only
+	// get the first half if it's flushed right away.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", proxy.URL+"/api/live", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("first write wasn't flushed to the client: %v", err)
+	}
+	defer res.Body.Close()
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(res.Body, b); err != nil {
+		t.Fatalf("first write wasn't flushed to the client: %v", err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("got %q; want hello", b)
+	}
+}
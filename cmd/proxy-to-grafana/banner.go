@@ -0,0 +1,77 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"flag"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// authKeyEnvs are the environment variables from which tsnet reads an
+// auth key.
+var authKeyEnvs = []string{"TS_AUTHKEY", "TS_AUTH_KEY"}
+
+// secretFlags are the flags whose values are never logged, as they name
+// secrets or where to find them.
+var secretFlags = map[string]bool{
+	"jwt-key-file":      true,
+	"provision-webhook": true,
+	"user-map-url":      true,
+}
+
+// logConfig logs, on one line, the flags that differ from their
+// defaults and which auth key environment variables are set, so it's
+// clear how the process was configured. It logs nothing with --quiet.
+func logConfig() {
+	infof("config: %s", configSummary())
+}
+
+// configSummary returns the non-default flags and the set auth key
+// environment variables, with secrets redacted.
+func configSummary() string {
+	var parts []string
+	for _, env := range authKeyEnvs {
+		if os.Getenv(env) != "" {
+			parts = append(parts, env+"=(redacted)")
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if v == f.DefValue {
+			return
+		}
+		if secretFlags[f.Name] {
+			v = "(redacted)"
+		} else {
+			v = redactFlagValue(v)
+		}
+		parts = append(parts, "--"+f.Name+"="+v)
+	})
+	if len(parts) == 0 {
+		return "defaults"
+	}
+	return strings.Join(parts, " ")
+}
+
+// redactFlagValue returns v with any credentials it might contain
+// removed: Tailscale auth keys, and the password and query of URLs,
+// which may carry tokens.
+func redactFlagValue(v string) string {
+	if strings.Contains(v, "tskey-") {
+		return "(redacted)"
+	}
+	if !strings.Contains(v, "://") {
+		return v
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return "(unparseable URL, redacted)"
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "redacted"
+	}
+	return u.Redacted() // replaces any password with "xxxxx"
+}
@@ -0,0 +1,47 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// capHeaderPrefix is the prefix of the headers set from the user's
+// capGrafanaHeaders capability. Requests' own headers with this prefix
+// are always removed, so they can't be spoofed.
+const capHeaderPrefix = "X-Tailscale-Cap-"
+
+// capHeadersHandler returns a handler that sets a header on each request
+// for every parameter of its user's capGrafanaHeaders capability: with
+// https://tailscale.com/cap/grafana-headers?featureX=true, the request
+// gets "X-Tailscale-Cap-Featurex: true". Parameters that don't make a
+// valid header are ignored.
+func capHeadersHandler(h http.Handler, lc whoIsClient) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k := range r.Header {
+			if strings.HasPrefix(k, capHeaderPrefix) {
+				delete(r.Header, k)
+			}
+		}
+		whois, err := whoIs(r.Context(), lc, r.RemoteAddr)
+		if err == nil {
+			q, _ := capParams(whois.Caps, capGrafanaHeaders)
+			for k, vv := range q {
+				name := capHeaderPrefix + k
+				if k == "" || !httpguts.ValidHeaderFieldName(name) {
+					continue
+				}
+				for _, v := range vv {
+					if httpguts.ValidHeaderFieldValue(v) {
+						r.Header.Add(name, v)
+					}
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,37 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCapHeaders(t *testing.T) {
+	defer func(v bool) { *capHeaders = v }(*capHeaders)
+	*capHeaders = true
+
+	lc := localhostUser("alice@example.com", "Alice Smith")
+	lc["127.0.0.1"].Caps = []string{capGrafanaHeaders + "?featureX=true&bad%20name=1&team=a&team=b&evil=x%0d%0aY:%20z"}
+	proxyURL, reqs := startProxy(t, lc)
+
+	r := get(t, proxyURL, "/d/abc", reqs, http.Header{"X-Tailscale-Cap-Admin": {"true"}})
+	if got := r.Header.Get("X-Tailscale-Cap-FeatureX"); got != "true" {
+		t.Errorf("X-Tailscale-Cap-FeatureX = %q; want true", got)
+	}
+	if got := r.Header.Values("X-Tailscale-Cap-Team"); len(got) != 2 {
+		t.Errorf("X-Tailscale-Cap-Team = %q; want [a b]", got)
+	}
+	if got := r.Header.Get("X-Tailscale-Cap-Admin"); got != "" {
+		t.Errorf("client-supplied X-Tailscale-Cap-Admin = %q reached backend", got)
+	}
+	if got := r.Header.Get("X-Tailscale-Cap-Evil"); got != "" {
+		t.Errorf("invalid header value %q reached backend", got)
+	}
+	for k := range r.Header {
+		if k == "X-Tailscale-Cap-Bad Name" || k == "Y" {
+			t.Errorf("invalid header %q reached backend", k)
+		}
+	}
+}
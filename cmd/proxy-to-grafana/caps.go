@@ -0,0 +1,48 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Peer capabilities that configure proxy-to-grafana per user. Like
+// tailcfg.CapabilityFunnelPorts, they carry their values as URL query
+// parameters, e.g. "https://tailscale.com/cap/grafana-org?id=2".
+const (
+	// capGrafanaOrg is the Grafana org ID the user is restricted to
+	// with --enforce-org, in its "id" parameter.
+	capGrafanaOrg = "https://tailscale.com/cap/grafana-org"
+
+	// capGrafanaHeaders are headers to set on the user's requests
+	// with --cap-headers, one per parameter; see capHeadersHandler.
+	capGrafanaHeaders = "https://tailscale.com/cap/grafana-headers"
+
+	// capGrafanaSession is the maximum age of the user's Grafana
+	// sessions with --enforce-session-age, as a Go duration in its
+	// "max-age" parameter.
+	capGrafanaSession = "https://tailscale.com/cap/grafana-session"
+)
+
+// capParams returns the query parameters of the first capability in caps
+// named capName (ignoring its query), and whether there was one.
+func capParams(caps []string, capName string) (url.Values, bool) {
+	for _, c := range caps {
+		if !strings.HasPrefix(c, capName) {
+			continue
+		}
+		u, err := url.Parse(c)
+		if err != nil {
+			continue
+		}
+		q := u.Query()
+		u.RawQuery = ""
+		if u.String() != capName {
+			continue
+		}
+		return q, true
+	}
+	return nil, false
+}
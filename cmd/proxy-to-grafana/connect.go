@@ -0,0 +1,98 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// connectDialTimeout bounds how long we try to reach a CONNECT target.
+const connectDialTimeout = 10 * time.Second
+
+// parseConnectTargets parses a comma-separated list of host:port CONNECT
+// targets.
+func parseConnectTargets(s string) ([]string, error) {
+	var targets []string
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(t); err != nil {
+			return nil, fmt.Errorf("bad CONNECT target %q: %w", t, err)
+		}
+		targets = append(targets, strings.ToLower(t))
+	}
+	return targets, nil
+}
+
+// connectHandler returns a handler that serves CONNECT requests from
+// identified Tailscale users by tunneling them to the requested target,
+// if it's one of targets. Other requests go to h.
+func connectHandler(h http.Handler, lc whoIsClient, targets []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ri := getRequestInfo(r.Context())
+		whois, err := getTailscaleUser(r.Context(), lc, r.RemoteAddr)
+		if err != nil {
+			log.Printf("request %s: CONNECT: error getting Tailscale user for %s: %v", ri.id, r.RemoteAddr, err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		target := strings.ToLower(r.Host)
+		if !slices.Contains(targets, target) {
+			log.Printf("request %s: CONNECT from %s to %q not allowed", ri.id, whois.UserProfile.LoginName, r.Host)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "CONNECT requires HTTP/1.1", http.StatusHTTPVersionNotSupported)
+			return
+		}
+
+		d := net.Dialer{Timeout: connectDialTimeout}
+		out, err := d.DialContext(r.Context(), "tcp", target)
+		if err != nil {
+			log.Printf("request %s: CONNECT to %s: %v", ri.id, target, err)
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		defer out.Close()
+		in, brw, err := hj.Hijack()
+		if err != nil {
+			log.Printf("request %s: CONNECT: hijack: %v", ri.id, err)
+			return
+		}
+		defer in.Close()
+		if _, err := io.WriteString(in, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			return
+		}
+		log.Printf("request %s: CONNECT tunnel from %s to %s", ri.id, whois.UserProfile.LoginName, target)
+
+		errc := make(chan error, 2)
+		go func() {
+			// Include anything the client sent after the request
+			// that's already been buffered.
+			_, err := io.Copy(out, brw.Reader)
+			errc <- err
+		}()
+		go func() {
+			_, err := io.Copy(in, out)
+			errc <- err
+		}()
+		<-errc
+	})
+}
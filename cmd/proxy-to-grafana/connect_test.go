@@ -0,0 +1,74 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestConnect(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	defer func(v string) { *allowConnect = v }(*allowConnect)
+	*allowConnect = echo.Addr().String()
+
+	// connect sends a CONNECT request for target through the proxy and
+	// returns the connection and response.
+	connect := func(proxyURL, target string) (net.Conn, *bufio.Reader, *http.Response) {
+		t.Helper()
+		c, err := net.Dial("tcp", strings.TrimPrefix(proxyURL, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		br := bufio.NewReader(c)
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, br, res
+	}
+
+	proxyURL, _ := startProxy(t, localhostUser("alice@example.com", "Alice Smith"))
+	c, br, res := connect(proxyURL, echo.Addr().String())
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT to allowed target: %v", res.Status)
+	}
+	io.WriteString(c, "hello\n")
+	if line, err := br.ReadString('\n'); err != nil || line != "hello\n" {
+		t.Errorf("through tunnel: got %q, %v; want hello", line, err)
+	}
+
+	if _, _, res := connect(proxyURL, "example.com:443"); res.StatusCode != http.StatusForbidden {
+		t.Errorf("CONNECT to other target: %v; want 403", res.Status)
+	}
+
+	proxyURL, _ = startProxy(t, fakeWhoIs{})
+	if _, _, res := connect(proxyURL, echo.Addr().String()); res.StatusCode != http.StatusForbidden {
+		t.Errorf("CONNECT by unknown user: %v; want 403", res.Status)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// lastControlContact is when, in Unix nanoseconds, checkBackendState
+// last saw the node in contact with control, or zero if it hasn't yet.
+var lastControlContact atomic.Int64
+
+// inContactWithControl reports whether st says the node is in its long
+// poll with control and hearing from it. Control only sends a new
+// netmap when something in the tailnet changes, but it sends keep-alives
+// on the poll regardless, so unlike a netmap's age, this holds in a
+// quiet tailnet.
+func inContactWithControl(st *ipnstate.Status) bool {
+	if st.Self == nil || !st.Self.Online {
+		return false
+	}
+	for _, h := range st.Health {
+		if strings.HasPrefix(h, "no map response") {
+			return false
+		}
+	}
+	return true
+}
+
+// controlSilenceHandler returns a handler that fails requests with 503
+// Service Unavailable while the node hasn't been in contact with
+// control for longer than maxSilence, as during a long control outage,
+// so users aren't identified from stale data. Otherwise it passes
+// requests to h. Until the first contact, silence is counted from when
+// the handler was made, so requests aren't rejected while starting up.
+func controlSilenceHandler(h http.Handler, maxSilence time.Duration) http.Handler {
+	start := time.Now()
+	var stale atomic.Bool
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since := start
+		if last := lastControlContact.Load(); last != 0 {
+			since = time.Unix(0, last)
+		}
+		isStale := time.Since(since) > maxSilence
+		if stale.Swap(isStale) != isStale {
+			if isStale {
+				log.Printf("no contact with control for longer than --max-control-silence=%v; rejecting requests until it's back", maxSilence)
+			} else {
+				log.Printf("in contact with control again; serving requests")
+			}
+		}
+		if isStale {
+			w.Header().Set("Retry-After", retryAfterSeconds)
+			http.Error(w, "Tailscale identity data is out of date; try again later", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,85 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+func TestControlSilenceHandler(t *testing.T) {
+	defer func(v int64) { lastControlContact.Store(v) }(lastControlContact.Load())
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := controlSilenceHandler(ok, time.Minute)
+
+	for _, tt := range []struct {
+		name string
+		last time.Time
+		want int
+	}{
+		{"no contact yet", time.Time{}, http.StatusOK},
+		{"in contact", time.Now().Add(-10 * time.Second), http.StatusOK},
+		{"out of contact", time.Now().Add(-2 * time.Minute), http.StatusServiceUnavailable},
+	} {
+		if tt.last.IsZero() {
+			lastControlContact.Store(0)
+		} else {
+			lastControlContact.Store(tt.last.UnixNano())
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/d/abc", nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s: got %v; want %v", tt.name, rec.Code, tt.want)
+		}
+	}
+
+	// Never in contact, for longer than the limit since starting.
+	lastControlContact.Store(0)
+	h = controlSilenceHandler(ok, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/d/abc", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("no contact since start: got %v; want 503", rec.Code)
+	}
+}
+
+// controlStatus is a statusClient reporting a Running backend with the
+// given status of its own node and health problems.
+type controlStatus struct {
+	self   *ipnstate.PeerStatus
+	health []string
+}
+
+func (c controlStatus) StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error) {
+	return &ipnstate.Status{BackendState: "Running", Self: c.self, Health: c.health}, nil
+}
+
+func TestControlContact(t *testing.T) {
+	defer func(v int64) { lastControlContact.Store(v) }(lastControlContact.Load())
+	defer backendState.Store(backendState.Load())
+
+	for _, tt := range []struct {
+		name string
+		st   controlStatus
+		want bool
+	}{
+		{"no self", controlStatus{}, false},
+		{"not in map poll", controlStatus{self: &ipnstate.PeerStatus{}}, false},
+		{"no map response", controlStatus{self: &ipnstate.PeerStatus{Online: true}, health: []string{"no map response in 3m0s"}}, false},
+		{"other health problem", controlStatus{self: &ipnstate.PeerStatus{Online: true}, health: []string{"no DERP home"}}, true},
+		{"in contact", controlStatus{self: &ipnstate.PeerStatus{Online: true}}, true},
+	} {
+		lastControlContact.Store(0)
+		checkBackendState(tt.st)
+		if got := lastControlContact.Load() != 0; got != tt.want {
+			t.Errorf("%s: in contact = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// pathPatterns is a list of URL path patterns. A pattern containing any
+// of the glob characters "*?[" matches paths per path.Match; any other
+// pattern matches that path and everything under it, so "/api/admin"
+// matches "/api/admin" and "/api/admin/users" but not "/api/administer".
+//
+// Matching is case-insensitive and on the cleaned path, so that
+// variations like "/API//admin/" don't slip past.
+type pathPatterns []string
+
+// parsePathPatterns parses a comma-separated list of pathPatterns.
+func parsePathPatterns(s string) (pathPatterns, error) {
+	var pp pathPatterns
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("path pattern %q doesn't start with /", p)
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("bad path pattern %q: %w", p, err)
+		}
+		pp = append(pp, strings.ToLower(path.Clean(p)))
+	}
+	return pp, nil
+}
+
+// match reports whether any pattern in pp matches the URL path p.
+func (pp pathPatterns) match(p string) bool {
+	p = strings.ToLower(path.Clean("/" + p))
+	for _, pat := range pp {
+		if strings.ContainsAny(pat, "*?[") {
+			if ok, _ := path.Match(pat, p); ok {
+				return true
+			}
+			continue
+		}
+		if p == pat || pat == "/" || strings.HasPrefix(p, pat+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// denyPathsHandler returns a handler that rejects requests for paths
+// matching deny with 403 Forbidden.
+func denyPathsHandler(h http.Handler, deny pathPatterns) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if deny.match(r.URL.Path) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,50 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import "testing"
+
+func TestPathPatterns(t *testing.T) {
+	pp, err := parsePathPatterns("/admin, /api/admin/ ,/api/dashboards/uid/*/versions,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		// Exact matches.
+		{"/admin", true},
+		{"/api/admin", true},
+		{"/api/dashboards/uid/abc/versions", true},
+
+		// Prefix matches, only at path segment boundaries.
+		{"/admin/users", true},
+		{"/api/admin/settings", true},
+		{"/administrator", false},
+		{"/api/adminx", false},
+		{"/api/dashboards/uid/abc/versions/2", false},
+
+		// Variations that mean the same path.
+		{"/API/Admin", true},
+		{"//api//admin/", true},
+		{"/api/./admin", true},
+		{"/d/../admin", true},
+
+		{"/", false},
+		{"/d/abc", false},
+		{"/api/dashboards/uid/abc", false},
+	}
+	for _, tt := range tests {
+		if got := pp.match(tt.path); got != tt.want {
+			t.Errorf("match(%q) = %v; want %v", tt.path, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"admin", "/api/[", "/ok,nope"} {
+		if _, err := parsePathPatterns(bad); err == nil {
+			t.Errorf("parsePathPatterns(%q) succeeded; want error", bad)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// nodeExpired reports whether n's node key has expired as of now, either
+// as control says or per its key expiry time.
+func nodeExpired(n *tailcfg.Node, now time.Time) bool {
+	return n.Expired || (!n.KeyExpiry.IsZero() && !now.Before(n.KeyExpiry))
+}
+
+// rejectExpiredHandler returns a handler that rejects requests from
+// nodes whose key has expired with 403 Forbidden, for
+// --reject-expired-nodes, in case WhoIs still knows them.
+func rejectExpiredHandler(h http.Handler, lc whoIsClient) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		whois, err := whoIs(r.Context(), lc, r.RemoteAddr)
+		if err == nil && whois.Node != nil && nodeExpired(whois.Node, time.Now()) {
+			log.Printf("request %s: rejecting node %s, whose key expired", getRequestInfo(r.Context()).id, whois.Node.Name)
+			http.Error(w, "This device's Tailscale key has expired. Please reauthenticate it.", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
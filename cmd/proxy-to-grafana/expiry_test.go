@@ -0,0 +1,43 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestRejectExpiredNodes(t *testing.T) {
+	defer func(v bool) { *rejectExpired = v }(*rejectExpired)
+	*rejectExpired = true
+
+	for _, tt := range []struct {
+		name    string
+		node    tailcfg.Node
+		expired bool
+	}{
+		{"never expires", tailcfg.Node{}, false},
+		{"expires later", tailcfg.Node{KeyExpiry: time.Now().Add(time.Hour)}, false},
+		{"expired key", tailcfg.Node{KeyExpiry: time.Now().Add(-time.Hour)}, true},
+		{"expired per control", tailcfg.Node{Expired: true}, true},
+	} {
+		lc := localhostUser("alice@example.com", "Alice Smith")
+		node := tt.node
+		node.Name = "laptop.example.ts.net."
+		lc["127.0.0.1"].Node = &node
+
+		proxyURL, _ := startProxy(t, lc)
+		res, err := http.Get(proxyURL + "/d/abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if got := res.StatusCode == http.StatusForbidden; got != tt.expired {
+			t.Errorf("%s: got %v; want rejected = %v", tt.name, res.Status, tt.expired)
+		}
+	}
+}
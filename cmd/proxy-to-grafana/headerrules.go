@@ -0,0 +1,173 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/exp/slices"
+	"golang.org/x/net/http/httpguts"
+)
+
+// A headerRule is one line of a --header-rules file. Each line is
+//
+//	<direction> <action> <header> [<arg>]
+//
+// where direction is "request" (to Grafana) or "response" (to the
+// client), and action is one of:
+//
+//	set <header> <value>     replace any values of header with value
+//	add <header> <value>     add value to any existing values of header
+//	remove <header>          remove header
+//	rename <header> <new>    move header's values to the header named new
+//
+// The value is the rest of the line, and may contain spaces. Blank lines
+// and lines starting with # are ignored. Rules are applied in order.
+type headerRule struct {
+	response bool
+	action   string
+	header   string // canonicalized
+	arg      string // value, or new header name, canonicalized, for rename
+}
+
+// headerRules are the rules from --header-rules, replaced on SIGHUP.
+// It's nil if there are none.
+var headerRules atomic.Pointer[[]headerRule]
+
+// parseHeaderRules parses the rules in a --header-rules file.
+func parseHeaderRules(r io.Reader) ([]headerRule, error) {
+	identity := mustIdentityStyle().headers()
+	var rules []headerRule
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		rule, err := parseHeaderRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		target := rule.header
+		if rule.action == "rename" {
+			target = rule.arg
+		}
+		if !rule.response && rule.action != "remove" && slices.Contains(identity, target) {
+			// Anything copied or written there would sign users in.
+			return nil, fmt.Errorf("line %d: can't %s identity header %s", line, rule.action, target)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, s.Err()
+}
+
+func parseHeaderRule(text string) (headerRule, error) {
+	direction, rest := cutField(text)
+	action, rest := cutField(rest)
+	header, arg := cutField(rest)
+
+	var rule headerRule
+	switch direction {
+	case "request":
+	case "response":
+		rule.response = true
+	default:
+		return rule, fmt.Errorf("unknown direction %q; want request or response", direction)
+	}
+	if !httpguts.ValidHeaderFieldName(header) {
+		return rule, fmt.Errorf("invalid header name %q", header)
+	}
+	rule.action = action
+	rule.header = http.CanonicalHeaderKey(header)
+	switch action {
+	case "set", "add":
+		if arg == "" || !httpguts.ValidHeaderFieldValue(arg) {
+			return rule, fmt.Errorf("missing or invalid value for %s", action)
+		}
+		rule.arg = arg
+	case "remove":
+		if arg != "" {
+			return rule, fmt.Errorf("unexpected %q after remove %s", arg, header)
+		}
+	case "rename":
+		if !httpguts.ValidHeaderFieldName(arg) {
+			return rule, fmt.Errorf("missing or invalid new header name %q", arg)
+		}
+		rule.arg = http.CanonicalHeaderKey(arg)
+	default:
+		return rule, fmt.Errorf("unknown action %q; want set, add, remove or rename", action)
+	}
+	return rule, nil
+}
+
+// cutField returns the first space-separated field of s and the rest of
+// s after it, with surrounding space removed.
+func cutField(s string) (field, rest string) {
+	field, rest, _ = strings.Cut(strings.TrimSpace(s), " ")
+	return field, strings.TrimSpace(rest)
+}
+
+// applyHeaderRules applies the current request or response rules to h.
+func applyHeaderRules(h http.Header, response bool) {
+	rules := headerRules.Load()
+	if rules == nil {
+		return
+	}
+	for _, rule := range *rules {
+		if rule.response != response {
+			continue
+		}
+		switch rule.action {
+		case "set":
+			h.Set(rule.header, rule.arg)
+		case "add":
+			h.Add(rule.header, rule.arg)
+		case "remove":
+			h.Del(rule.header)
+		case "rename":
+			if vs := h.Values(rule.header); len(vs) > 0 {
+				h.Del(rule.header)
+				h[rule.arg] = vs
+			}
+		}
+	}
+}
+
+// loadHeaderRules reads --header-rules and makes its rules current.
+func loadHeaderRules() error {
+	f, err := os.Open(*headerRulesFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rules, err := parseHeaderRules(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *headerRulesFile, err)
+	}
+	headerRules.Store(&rules)
+	return nil
+}
+
+// reloadHeaderRulesOnSignal re-reads --header-rules on each SIGHUP. If
+// the file can't be loaded, the previous rules stay in effect.
+func reloadHeaderRulesOnSignal() {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+	for range sigc {
+		if err := loadHeaderRules(); err != nil {
+			log.Printf("error reloading --header-rules; keeping the old rules: %v", err)
+		} else {
+			log.Printf("reloaded --header-rules")
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testHeaderRules = `
+# Tell Grafana which org to use.
+request  set    X-Scope-OrgID   1
+request  add    X-Via proxy-to-grafana on tailnet
+request  remove Cookie-Debug
+request  rename X-Client-Trace  X-Trace
+response remove Server
+response set    X-Frame-Options SAMEORIGIN
+`
+
+func TestParseHeaderRules(t *testing.T) {
+	rules, err := parseHeaderRules(strings.NewReader(testHeaderRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.Header{
+		"Cookie-Debug":   {"1"},
+		"X-Client-Trace": {"abc"},
+		"X-Via":          {"lb"},
+	}
+	headerRules.Store(&rules)
+	defer headerRules.Store(nil)
+	applyHeaderRules(h, false)
+	want := http.Header{
+		"X-Scope-Orgid": {"1"},
+		"X-Trace":       {"abc"},
+		"X-Via":         {"lb", "proxy-to-grafana on tailnet"},
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("request headers = %v; want %v", h, want)
+	}
+
+	for _, bad := range []string{
+		"request set X-Foo",
+		"request frob X-Foo bar",
+		"upstream set X-Foo bar",
+		"request remove X-Foo bar",
+		"request rename X-Foo",
+		"request set Bad:Name x",
+		"request set X-Webauth-User admin",
+		"request rename X-Foo x-webauth-name",
+	} {
+		if _, err := parseHeaderRules(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseHeaderRules(%q) succeeded; want error", bad)
+		}
+	}
+	// Removing an identity header is harmless.
+	if _, err := parseHeaderRules(strings.NewReader("request remove X-Webauth-Name")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHeaderRulesCustomIdentityPrefix(t *testing.T) {
+	defer func(s, p string) { *identityStyleName, *identityHeaderPrefix = s, p }(*identityStyleName, *identityHeaderPrefix)
+	*identityStyleName = "custom"
+	*identityHeaderPrefix = "x-auth-request-"
+	for _, bad := range []string{
+		"request set X-Auth-Request-User admin",
+		"request rename X-Foo x-auth-request-name",
+	} {
+		if _, err := parseHeaderRules(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseHeaderRules(%q) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestHeaderRulesProxy(t *testing.T) {
+	defer func(v string) { *headerRulesFile = v }(*headerRulesFile)
+	*headerRulesFile = "rules.txt"
+	rules, err := parseHeaderRules(strings.NewReader(testHeaderRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerRules.Store(&rules)
+	defer headerRules.Store(nil)
+
+	proxyURL, reqs := startProxy(t, localhostUser("alice@example.com", "Alice Smith"))
+	r := get(t, proxyURL, "/login", reqs, http.Header{"X-Client-Trace": {"abc"}})
+	if got := r.Header.Get("X-Scope-OrgID"); got != "1" {
+		t.Errorf("X-Scope-OrgID = %q; want 1", got)
+	}
+	if got := r.Header.Get("X-Trace"); got != "abc" {
+		t.Errorf("X-Trace = %q; want abc", got)
+	}
+	if got := r.Header.Get("X-Webauth-User"); got != "alice@example.com" {
+		t.Errorf("X-Webauth-User = %q; want alice@example.com", got)
+	}
+
+	res, err := http.Get(proxyURL + "/d/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	<-reqs
+	if got := res.Header.Get("X-Frame-Options"); got != "SAMEORIGIN" {
+		t.Errorf("response X-Frame-Options = %q; want SAMEORIGIN", got)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"tailscale.com/tailcfg"
+)
+
+// A RequestHook processes a request after proxy-to-grafana has tried to
+// identify its Tailscale user, and before it's forwarded to Grafana. It
+// may modify r, such as by setting headers. user is nil if the user
+// couldn't be identified; if it's not, the rest of its WhoIs response,
+// such as its node and capabilities, is getRequestInfo(r.Context()).whois.
+//
+// A non-nil error aborts the request: with the HTTP status of a
+// *HookError, or 403 Forbidden otherwise. The error's text is sent to
+// the client.
+//
+// With the default --identity-style, users are only identified on
+// Grafana's /login page (see modifyRequest), so hooks only run there.
+type RequestHook func(r *http.Request, user *tailcfg.UserProfile) error
+
+// HookError is an error returned by a RequestHook to abort its request
+// with a specific HTTP status.
+type HookError struct {
+	Status int // HTTP status code
+	Err    error
+}
+
+func (e *HookError) Error() string { return e.Err.Error() }
+func (e *HookError) Unwrap() error { return e.Err }
+
+// defaultHooks are the hooks that implement proxy-to-grafana's own
+// behavior. They run before any others.
+var defaultHooks = []RequestHook{
+	setIdentityHeaders,
+}
+
+// hooksHandler returns a handler that identifies each request's user and
+// runs hooks on it, per modifyRequest, before passing it on to h.
+func hooksHandler(h http.Handler, lc whoIsClient, hooks []RequestHook, noAuth pathPatterns) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := modifyRequest(r, lc, hooks, noAuth); err != nil {
+			status := http.StatusForbidden
+			var he *HookError
+			if errors.As(err, &he) {
+				status = he.Status
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,175 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+
+	"golang.org/x/net/http/httpguts"
+	"tailscale.com/tailcfg"
+)
+
+// identityStyle describes the headers with which a backend expects to be
+// told who the user is.
+type identityStyle struct {
+	user  string // header for the login name
+	name  string // header for the display name, if any
+	email string // header for the login name as an email address, if any
+
+	// loginOnly is whether the user is only identified on /login, as
+	// Grafana needs; see modifyRequest. Otherwise every request is.
+	loginOnly bool
+}
+
+// headers returns the headers s sets, in canonical form, as a custom
+// --identity-header-prefix needn't be.
+func (s identityStyle) headers() []string {
+	var hs []string
+	for _, h := range []string{s.user, s.name, s.email} {
+		if h != "" {
+			hs = append(hs, http.CanonicalHeaderKey(h))
+		}
+	}
+	return hs
+}
+
+// identityStyles are the --identity-style values, except "custom".
+var identityStyles = map[string]identityStyle{
+	"grafana": {
+		user:      "X-Webauth-User",
+		name:      "X-Webauth-Name",
+		loginOnly: true,
+	},
+	// The headers oauth2-proxy sends its upstreams with
+	// --pass-user-headers.
+	"oauth2-proxy": {
+		user:  "X-Forwarded-User",
+		email: "X-Forwarded-Email",
+	},
+}
+
+// currentIdentityStyle returns the identityStyle for --identity-style
+// and --identity-header-prefix.
+func currentIdentityStyle() (identityStyle, error) {
+	if *identityStyleName == "custom" {
+		p := *identityHeaderPrefix
+		if p == "" || !httpguts.ValidHeaderFieldName(p) {
+			return identityStyle{}, fmt.Errorf("invalid --identity-header-prefix %q", p)
+		}
+		return identityStyle{user: p + "User", name: p + "Name"}, nil
+	}
+	s, ok := identityStyles[*identityStyleName]
+	if !ok {
+		return identityStyle{}, fmt.Errorf("unknown --identity-style %q; want grafana, oauth2-proxy or custom", *identityStyleName)
+	}
+	return s, nil
+}
+
+// mustIdentityStyle is currentIdentityStyle for after validateFlags has
+// checked the flags.
+func mustIdentityStyle() identityStyle {
+	s, err := currentIdentityStyle()
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// setIdentityHeaders sets the headers with which the backend signs in
+// user, per --identity-style, with its login name adjusted per
+// --username-sanitize.
+func setIdentityHeaders(r *http.Request, user *tailcfg.UserProfile) error {
+	if user == nil {
+		return nil
+	}
+	name, err := sanitizeUsername(user.LoginName, *sanitizeMode)
+	if err != nil {
+		return err
+	}
+	s := mustIdentityStyle()
+	r.Header.Set(s.user, name)
+	if s.name != "" {
+		r.Header.Set(s.name, displayName(r, user))
+	}
+	if s.email != "" && strings.Contains(user.LoginName, "@") {
+		r.Header.Set(s.email, user.LoginName)
+	}
+	return nil
+}
+
+// nameTemplateData is what a --name-template is executed with.
+type nameTemplateData struct {
+	User    *tailcfg.UserProfile // as signed in, with LoginName and DisplayName
+	Node    string               // MagicDNS name of the user's node, like "laptop.example.ts.net"
+	Tailnet string               // tailnet domain of the user's node, like "example.ts.net"
+}
+
+// parseNameTemplate parses a --name-template and checks that it executes.
+func parseNameTemplate(src string) (*template.Template, error) {
+	t, err := template.New("name").Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	sample := nameTemplateData{
+		User:    &tailcfg.UserProfile{LoginName: "alice@example.com", DisplayName: "Alice"},
+		Node:    "laptop.example.ts.net",
+		Tailnet: "example.ts.net",
+	}
+	if err := t.Execute(new(bytes.Buffer), sample); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+var nameTemplateCache struct {
+	sync.Mutex
+	src string
+	t   *template.Template
+}
+
+// currentNameTemplate returns the parsed --name-template, which
+// validateFlags has checked.
+func currentNameTemplate() *template.Template {
+	c := &nameTemplateCache
+	c.Lock()
+	defer c.Unlock()
+	if c.t == nil || c.src != *nameTemplate {
+		t, err := parseNameTemplate(*nameTemplate)
+		if err != nil {
+			panic(err)
+		}
+		c.src, c.t = *nameTemplate, t
+	}
+	return c.t
+}
+
+// displayName returns the display name to give the backend for user,
+// per --name-template, or else their Tailscale display name.
+func displayName(r *http.Request, user *tailcfg.UserProfile) string {
+	if *nameTemplate == "" {
+		return user.DisplayName
+	}
+	data := nameTemplateData{User: user}
+	if whois := getRequestInfo(r.Context()).whois; whois != nil && whois.Node != nil {
+		data.Node = strings.TrimSuffix(whois.Node.Name, ".")
+		data.Tailnet = tailnetOf(whois.Node)
+	}
+	var buf bytes.Buffer
+	if err := currentNameTemplate().Execute(&buf, data); err != nil {
+		log.Printf("request %s: --name-template: %v", getRequestInfo(r.Context()).id, err)
+		return user.DisplayName
+	}
+	name := strings.TrimSpace(buf.String())
+	if name == "" || !httpguts.ValidHeaderFieldValue(name) {
+		log.Printf("request %s: --name-template gave invalid name %q for %s", getRequestInfo(r.Context()).id, name, user.LoginName)
+		return user.DisplayName
+	}
+	return name
+}
@@ -0,0 +1,84 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIdentityStyle(t *testing.T) {
+	defer func(s, p string) { *identityStyleName, *identityHeaderPrefix = s, p }(*identityStyleName, *identityHeaderPrefix)
+
+	*identityStyleName = "oauth2-proxy"
+	proxyURL, reqs := startProxy(t, localhostUser("alice@example.com", "Alice Smith"))
+	spoofed := http.Header{"X-Forwarded-User": {"admin"}}
+	// Every request is identified, not just /login.
+	r := get(t, proxyURL, "/api/dashboards", reqs, spoofed)
+	if got := r.Header.Get("X-Forwarded-User"); got != "alice@example.com" {
+		t.Errorf("X-Forwarded-User = %q; want alice@example.com", got)
+	}
+	if got := r.Header.Get("X-Forwarded-Email"); got != "alice@example.com" {
+		t.Errorf("X-Forwarded-Email = %q; want alice@example.com", got)
+	}
+	if got := r.Header.Get("X-Webauth-User"); got != "" {
+		t.Errorf("X-Webauth-User = %q; want empty", got)
+	}
+
+	proxyURL, reqs = startProxy(t, fakeWhoIs{})
+	r = get(t, proxyURL, "/api/dashboards", reqs, spoofed)
+	if got := r.Header.Get("X-Forwarded-User"); got != "" {
+		t.Errorf("spoofed X-Forwarded-User = %q reached backend", got)
+	}
+
+	*identityStyleName = "custom"
+	*identityHeaderPrefix = "X-Auth-Request-"
+	proxyURL, reqs = startProxy(t, localhostUser("alice@example.com", "Alice Smith"))
+	r = get(t, proxyURL, "/", reqs, nil)
+	if got := r.Header.Get("X-Auth-Request-User"); got != "alice@example.com" {
+		t.Errorf("X-Auth-Request-User = %q; want alice@example.com", got)
+	}
+	if got := r.Header.Get("X-Auth-Request-Name"); got != "Alice Smith" {
+		t.Errorf("X-Auth-Request-Name = %q; want Alice Smith", got)
+	}
+}
+
+func TestNoAuthPaths(t *testing.T) {
+	defer func(s, p string) { *identityStyleName, *noAuthPaths = s, p }(*identityStyleName, *noAuthPaths)
+	*identityStyleName = "oauth2-proxy"
+	*noAuthPaths = "/public,/favicon.ico"
+
+	var whoIsCalls atomic.Int32
+	lc := countingWhoIs{localhostUser("alice@example.com", "Alice Smith"), &whoIsCalls}
+	proxyURL, reqs := startProxy(t, lc)
+	spoofed := http.Header{"X-Forwarded-User": {"admin"}}
+	for _, path := range []string{"/favicon.ico", "/public/build/app.js"} {
+		r := get(t, proxyURL, path, reqs, spoofed)
+		if got := r.Header.Get("X-Forwarded-User"); got != "" {
+			t.Errorf("%s: X-Forwarded-User = %q; want empty", path, got)
+		}
+	}
+	if n := whoIsCalls.Load(); n != 0 {
+		t.Errorf("%d WhoIs calls for --no-auth-paths; want 0", n)
+	}
+	r := get(t, proxyURL, "/api/dashboards", reqs, nil)
+	if got := r.Header.Get("X-Forwarded-User"); got != "alice@example.com" {
+		t.Errorf("/api/dashboards: X-Forwarded-User = %q; want alice@example.com", got)
+	}
+}
+
+func TestNameTemplate(t *testing.T) {
+	defer func(v string) { *nameTemplate = v }(*nameTemplate)
+	*nameTemplate = "{{.User.DisplayName}} ({{.Tailnet}})"
+
+	proxyURL, reqs := startProxy(t, localhostUser("alice@example.com", "Alice Smith"))
+	r := get(t, proxyURL, "/login", reqs, nil)
+	if got, want := r.Header.Get("X-Webauth-Name"), "Alice Smith (example.ts.net)"; got != want {
+		t.Errorf("X-Webauth-Name = %q; want %q", got, want)
+	}
+	if got, want := r.Header.Get("X-Webauth-User"), "alice@example.com"; got != want {
+		t.Errorf("X-Webauth-User = %q; want %q", got, want)
+	}
+}
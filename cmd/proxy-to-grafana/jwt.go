@@ -0,0 +1,155 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// jwtLifetime is how long the JWTs we mint are valid. Each request gets
+// a fresh one, so this only needs to cover clock skew and slow requests.
+const jwtLifetime = 5 * time.Minute
+
+// jwtSigner signs JWTs with a private key.
+type jwtSigner struct {
+	key crypto.Signer
+	alg string // JWS "alg": "EdDSA", "ES256" or "RS256"
+}
+
+// loadJWTSigner returns a jwtSigner for the PEM-encoded PKCS #8, SEC 1
+// or PKCS #1 private key in file. Ed25519, ECDSA P-256 and RSA keys are
+// supported.
+func loadJWTSigner(file string) (*jwtSigner, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", file)
+	}
+	var key any
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing key in %s: %w", file, err)
+	}
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return &jwtSigner{k, "EdDSA"}, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported ECDSA curve %s in %s; want P-256", k.Curve.Params().Name, file)
+		}
+		return &jwtSigner{k, "ES256"}, nil
+	case *rsa.PrivateKey:
+		return &jwtSigner{k, "RS256"}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T in %s", key, file)
+}
+
+// jwtClaims are the claims in the JWTs we mint, in the style of an
+// OpenID Connect ID token.
+type jwtClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`            // login name
+	Name      string   `json:"name,omitempty"` // display name
+	Picture   string   `json:"picture,omitempty"`
+	Groups    []string `json:"groups,omitempty"` // the node's tags, for tagged nodes
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+// sign returns the signed, compact-serialized JWT for claims.
+func (s *jwtSigner) sign(claims *jwtClaims) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	msg := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+
+	var sig []byte
+	switch k := s.key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(msg))
+	case *ecdsa.PrivateKey:
+		h := sha256.Sum256([]byte(msg))
+		r, ss, err := ecdsa.Sign(rand.Reader, k, h[:])
+		if err != nil {
+			return "", err
+		}
+		// JWS wants the fixed-size concatenation of r and s, not ASN.1.
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		ss.FillBytes(sig[32:])
+	case *rsa.PrivateKey:
+		h := sha256.Sum256([]byte(msg))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, h[:])
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", errors.New("unsupported key type")
+	}
+	return msg + "." + enc.EncodeToString(sig), nil
+}
+
+// jwtHandler returns a handler that sets the named header on each
+// request from an identified Tailscale user to a JWT, signed by s,
+// describing that user, for Grafana plugins that authenticate with JWTs.
+// The header is removed from other requests.
+func jwtHandler(h http.Handler, lc whoIsClient, header, issuer string, s *jwtSigner) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(header)
+		whois, err := getTailscaleUser(r.Context(), lc, r.RemoteAddr)
+		if err == nil {
+			now := time.Now()
+			claims := &jwtClaims{
+				Issuer:    issuer,
+				Subject:   whois.UserProfile.LoginName,
+				Name:      whois.UserProfile.DisplayName,
+				Picture:   whois.UserProfile.ProfilePicURL,
+				IssuedAt:  now.Unix(),
+				ExpiresAt: now.Add(jwtLifetime).Unix(),
+			}
+			if whois.Node.IsTagged() {
+				claims.Groups = whois.Node.Tags
+			}
+			tok, err := s.sign(claims)
+			if err != nil {
+				log.Printf("request %s: error signing JWT: %v", getRequestInfo(r.Context()).id, err)
+			} else {
+				r.Header.Set(header, tok)
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,108 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKey writes key as a PEM-encoded PKCS #8 file and returns its path.
+func writeKey(t *testing.T, key any) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestJWTHeader(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(h, f string) { *jwtHeader, *jwtKeyFile = h, f }(*jwtHeader, *jwtKeyFile)
+	*jwtHeader = "X-JWT-Assertion"
+	*jwtKeyFile = writeKey(t, priv)
+
+	proxyURL, reqs := startProxy(t, localhostUser("alice@example.com", "Alice Smith"))
+	r := get(t, proxyURL, "/d/abc", reqs, http.Header{"X-JWT-Assertion": {"spoofed"}})
+	parts := strings.Split(r.Header.Get("X-JWT-Assertion"), ".")
+	if len(parts) != 3 {
+		t.Fatalf("X-JWT-Assertion = %q; want a JWT", r.Header.Get("X-JWT-Assertion"))
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(pub, []byte(parts[0]+"."+parts[1]), sig) {
+		t.Error("JWT signature doesn't verify")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "alice@example.com" || claims.Name != "Alice Smith" {
+		t.Errorf("claims = %+v; want alice@example.com, Alice Smith", claims)
+	}
+	if claims.ExpiresAt <= claims.IssuedAt {
+		t.Errorf("exp %d not after iat %d", claims.ExpiresAt, claims.IssuedAt)
+	}
+
+	proxyURL, reqs = startProxy(t, fakeWhoIs{})
+	r = get(t, proxyURL, "/d/abc", reqs, http.Header{"X-JWT-Assertion": {"spoofed"}})
+	if got := r.Header.Get("X-JWT-Assertion"); got != "" {
+		t.Errorf("X-JWT-Assertion for unknown user = %q; want empty", got)
+	}
+}
+
+func TestJWTSignES256(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadJWTSigner(writeKey(t, priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.alg != "ES256" {
+		t.Fatalf("alg = %q; want ES256", s.alg)
+	}
+	tok, err := s.sign(&jwtClaims{Subject: "alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := strings.LastIndex(tok, ".")
+	sig, err := base64.RawURLEncoding.DecodeString(tok[i+1:])
+	if err != nil || len(sig) != 64 {
+		t.Fatalf("bad signature %q: %v", tok[i+1:], err)
+	}
+	h := sha256.Sum256([]byte(tok[:i]))
+	r, ss := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&priv.PublicKey, h[:], r, ss) {
+		t.Error("JWT signature doesn't verify")
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+)
+
+// localConnKey is the context key marking requests that arrived on the
+// --local-addr listener rather than the tailnet.
+type localConnKey struct{}
+
+// isLocalConn reports whether the request with context ctx arrived on
+// the --local-addr listener.
+func isLocalConn(ctx context.Context) bool {
+	local, _ := ctx.Value(localConnKey{}).(bool)
+	return local
+}
+
+// newLocalServer returns a server for the --local-addr listener that
+// serves h, marking each request so whoIs signs it in as --loopback-user
+// rather than asking WhoIs, which can't identify connections from
+// outside the tailnet.
+func newLocalServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:        h,
+		MaxHeaderBytes: *maxHeaderBytes,
+		IdleTimeout:    *idleTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), localConnKey{}, true)
+		},
+	}
+}
+
+// startLocal serves h over plain HTTP on the host at addr, per
+// --local-addr, for local health checks and tests.
+func startLocal(addr string, h http.Handler) *http.Server {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := newLocalServer(h)
+	go serveUntilShutdown(srv, ln)
+	infof("also serving locally at %v", ln.Addr())
+	return srv
+}
@@ -0,0 +1,74 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// inMaintenance is whether we're serving the maintenance page rather
+// than proxying to Grafana.
+var inMaintenance atomic.Bool
+
+const maintenancePage = `<!DOCTYPE html>
+<html>
+<head><title>Grafana is down for maintenance</title></head>
+<body>
+<h1>Grafana is down for maintenance</h1>
+<p>It'll be back shortly. Please try again in a few minutes.</p>
+</body>
+</html>
+`
+
+// maintenanceHandler returns a handler that serves the maintenance page
+// while inMaintenance is set, and otherwise passes requests to h.
+func maintenanceHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !inMaintenance.Load() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Retry-After", retryAfterSeconds)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, maintenancePage)
+	})
+}
+
+// updateMaintenance sets inMaintenance per --maintenance and the
+// existence of --maintenance-file, logging any change.
+func updateMaintenance() {
+	on := *maintenance
+	if *maintenanceFile != "" {
+		if _, err := os.Stat(*maintenanceFile); err == nil {
+			on = true
+		} else if !os.IsNotExist(err) {
+			log.Printf("error checking --maintenance-file: %v", err)
+		}
+	}
+	if inMaintenance.Swap(on) != on {
+		if on {
+			log.Printf("entering maintenance mode")
+		} else {
+			log.Printf("leaving maintenance mode")
+		}
+	}
+}
+
+// watchMaintenanceFile calls updateMaintenance on each SIGHUP, so that
+// creating or removing --maintenance-file takes effect.
+func watchMaintenanceFile() {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+	for range sigc {
+		updateMaintenance()
+	}
+}
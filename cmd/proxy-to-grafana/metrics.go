@@ -0,0 +1,130 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/metrics"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsnet"
+	"tailscale.com/tsweb"
+)
+
+// Monitoring metrics, published under "proxy_to_grafana".
+var (
+	whoIsInFlight       expvar.Int // WhoIs calls currently holding a --whois-concurrency slot
+	tailscaleRunning    expvar.Int // 1 if the tailscale backend was Running when last checked
+	backendStateChanges expvar.Int // times the tailscale backend went into or out of Running
+)
+
+func init() {
+	m := &metrics.Set{}
+	m.Set("gauge_whois_in_flight", &whoIsInFlight)
+	m.Set("gauge_tailscale_running", &tailscaleRunning)
+	m.Set("counter_backend_state_changes", &backendStateChanges)
+	expvar.Publish("proxy_to_grafana", m)
+}
+
+// startDebug starts serving the debug and metrics endpoints at the
+// given port on localhost, or with --debug-tailnet, on the tailnet to
+// --admin-users, whom it uses lc to identify. It returns the server,
+// for shutting down.
+func startDebug(ts *tsnet.Server, port int, lc whoIsClient) *http.Server {
+	mux := http.NewServeMux()
+	debug := tsweb.Debugger(mux)
+	debug.Handle("whoami", "Who am I (or ?addr=ip:port is)", whoAmIHandler(lc))
+	debug.Handle("ready", "Readiness (200 if the tailscale backend is Running)", http.HandlerFunc(readyHandler))
+	var h http.Handler = mux
+	var ln net.Listener
+	var err error
+	if *debugTailnet {
+		h = adminOnlyHandler(h, lc, parseLoginList(*adminUsers))
+		ln, err = ts.Listen("tcp", fmt.Sprintf(":%d", port))
+	} else {
+		ln, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := &http.Server{Handler: h}
+	go serveUntilShutdown(srv, ln)
+	return srv
+}
+
+// adminOnlyHandler returns a handler that passes requests to h only if
+// they're from one of the Tailscale users in admins, and fails them with
+// 403 Forbidden otherwise. Tagged nodes are never admins.
+func adminOnlyHandler(h http.Handler, lc whoIsClient, admins []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		whois, err := lc.WhoIs(r.Context(), r.RemoteAddr)
+		switch {
+		case err != nil:
+			log.Printf("debug request from %s: error identifying user: %v", r.RemoteAddr, err)
+		case whois.Node.IsTagged() || whois.UserProfile == nil:
+		case slices.Contains(admins, strings.ToLower(whois.UserProfile.LoginName)):
+			h.ServeHTTP(w, r)
+			return
+		default:
+			log.Printf("debug request from %s denied: not in --admin-users", whois.UserProfile.LoginName)
+		}
+		http.Error(w, "debug endpoints are for --admin-users only", http.StatusForbidden)
+	})
+}
+
+// parseLoginList parses a comma-separated list of login names,
+// lowercasing them.
+func parseLoginList(s string) []string {
+	var logins []string
+	for _, l := range strings.Split(s, ",") {
+		if l = strings.ToLower(strings.TrimSpace(l)); l != "" {
+			logins = append(logins, l)
+		}
+	}
+	return logins
+}
+
+// whoAmIHandler returns a handler that replies with the WhoIs response
+// for the address in the "addr" query parameter, or else for the
+// requester, as JSON, along with the user proxy-to-grafana would sign
+// into Grafana as. It's for debugging identity mapping. As the answer
+// includes capabilities, it must only be reachable from localhost or by
+// --admin-users, as startDebug ensures.
+func whoAmIHandler(lc whoIsClient) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := r.URL.Query().Get("addr")
+		if addr == "" {
+			addr = r.RemoteAddr
+		}
+		res := struct {
+			Addr     string
+			WhoIs    *apitype.WhoIsResponse `json:",omitempty"`
+			WhoIsErr string                 `json:",omitempty"`
+			User     *tailcfg.UserProfile   `json:",omitempty"` // as signed into Grafana
+			UserErr  string                 `json:",omitempty"`
+		}{Addr: addr}
+		if whois, err := lc.WhoIs(r.Context(), addr); err != nil {
+			res.WhoIsErr = err.Error()
+		} else {
+			res.WhoIs = whois
+		}
+		if whois, err := getTailscaleUser(r.Context(), lc, addr); err != nil {
+			res.UserErr = err.Error()
+		} else {
+			res.User = whois.UserProfile
+		}
+		w.Header().Set("Content-Type", "application/json")
+		e := json.NewEncoder(w)
+		e.SetIndent("", "\t")
+		e.Encode(res)
+	})
+}
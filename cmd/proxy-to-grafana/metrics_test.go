@@ -0,0 +1,76 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestWhoAmI(t *testing.T) {
+	h := whoAmIHandler(localhostUser("alice@example.com", "Alice Smith"))
+	for _, tt := range []struct {
+		target, remoteAddr string
+		wantUser           string
+	}{
+		{"/debug/whoami", "127.0.0.1:1234", "alice@example.com"},
+		{"/debug/whoami?addr=127.0.0.1:80", "100.64.0.1:1234", "alice@example.com"},
+		{"/debug/whoami", "100.64.0.1:1234", ""},
+	} {
+		req := httptest.NewRequest("GET", tt.target, nil)
+		req.RemoteAddr = tt.remoteAddr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var res struct {
+			User    *struct{ LoginName string }
+			UserErr string
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s from %s: %v", tt.target, tt.remoteAddr, err)
+		}
+		got := ""
+		if res.User != nil {
+			got = res.User.LoginName
+		}
+		if got != tt.wantUser {
+			t.Errorf("%s from %s: user %q; want %q", tt.target, tt.remoteAddr, got, tt.wantUser)
+		}
+		if tt.wantUser == "" && res.UserErr == "" {
+			t.Errorf("%s from %s: no UserErr", tt.target, tt.remoteAddr)
+		}
+	}
+}
+
+func TestAdminOnlyHandler(t *testing.T) {
+	lc := localhostUser("alice@example.com", "Alice Smith")
+	lc["127.0.0.2"] = &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{ID: 3, Tags: []string{"tag:server"}},
+		UserProfile: &tailcfg.UserProfile{ID: 4, LoginName: "tagged-devices"},
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range []struct {
+		admins     string
+		remoteAddr string
+		want       int
+	}{
+		{"Alice@example.com, bob@example.com", "127.0.0.1:1234", http.StatusOK},
+		{"bob@example.com", "127.0.0.1:1234", http.StatusForbidden},
+		{"tagged-devices", "127.0.0.2:1234", http.StatusForbidden},
+		{"alice@example.com", "100.64.0.1:1234", http.StatusForbidden},
+	} {
+		h := adminOnlyHandler(ok, lc, parseLoginList(tt.admins))
+		req := httptest.NewRequest("GET", "/debug/vars", nil)
+		req.RemoteAddr = tt.remoteAddr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("admins %q, from %s: got %v; want %v", tt.admins, tt.remoteAddr, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/cmpver"
+)
+
+// clientVersion returns the short Tailscale version, like "1.38.2", that
+// n runs, or the empty string if it's unknown.
+func clientVersion(n *tailcfg.Node) string {
+	if n == nil || !n.Hostinfo.Valid() {
+		return ""
+	}
+	// Drop the "-t<commit>" and similar suffixes of version.Long.
+	v, _, _ := strings.Cut(n.Hostinfo.IPNVersion(), "-")
+	return v
+}
+
+// minVersionHandler returns a handler that rejects requests with 403
+// Forbidden when they come from nodes running a Tailscale version older
+// than min. Nodes whose version is unknown aren't checked.
+func minVersionHandler(h http.Handler, lc whoIsClient, min string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		whois, err := whoIs(r.Context(), lc, r.RemoteAddr)
+		if err == nil {
+			if v := clientVersion(whois.Node); v != "" && cmpver.Compare(v, min) < 0 {
+				log.Printf("request %s: rejecting %s running Tailscale %s", getRequestInfo(r.Context()).id, whois.Node.Name, v)
+				http.Error(w, fmt.Sprintf("Tailscale %s or newer is required; this device runs %s. Please update Tailscale.", min, v), http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
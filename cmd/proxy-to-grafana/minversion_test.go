@@ -0,0 +1,38 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestMinClientVersion(t *testing.T) {
+	defer func(v string) { *minClientVersion = v }(*minClientVersion)
+	*minClientVersion = "1.38.0"
+
+	for _, tt := range []struct {
+		version string
+		want    int
+	}{
+		{"1.36.2-t1234abcd-g5678ef", http.StatusForbidden},
+		{"1.38.0-t1234abcd-g5678ef", http.StatusOK},
+		{"1.40.1", http.StatusOK},
+		{"", http.StatusOK}, // unknown
+	} {
+		lc := localhostUser("alice@example.com", "Alice Smith")
+		lc["127.0.0.1"].Node.Hostinfo = (&tailcfg.Hostinfo{IPNVersion: tt.version}).View()
+		proxyURL, _ := startProxy(t, lc)
+		res, err := http.Get(proxyURL + "/d/abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.want {
+			t.Errorf("version %q: got %v; want %d", tt.version, res.Status, tt.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// grafanaOrgHeader is the header Grafana's API uses to select the org
+// a request applies to.
+const grafanaOrgHeader = "X-Grafana-Org-Id"
+
+// enforceOrgHandler returns a handler that pins each request to the
+// Grafana org named by the user's capGrafanaOrg capability, so users
+// can't switch to orgs they shouldn't see. It overrides the orgId query
+// parameter and X-Grafana-Org-Id header Grafana selects orgs with, and
+// denies the API and UI routes that change a user's current org.
+//
+// Users without the capability, or who can't be identified, have both
+// removed, leaving Grafana to use their default org.
+func enforceOrgHandler(h http.Handler, lc whoIsClient) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isOrgSwitch(r.URL.Path) {
+			http.Error(w, "switching orgs is disabled", http.StatusForbidden)
+			return
+		}
+		var org string
+		if whois, err := whoIs(r.Context(), lc, r.RemoteAddr); err == nil {
+			org = grafanaOrg(whois.Caps)
+		}
+		q := r.URL.Query()
+		if org == "" {
+			q.Del("orgId")
+			r.Header.Del(grafanaOrgHeader)
+		} else {
+			q.Set("orgId", org)
+			r.Header.Set(grafanaOrgHeader, org)
+		}
+		r.URL.RawQuery = q.Encode()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// orgSwitchPaths are the Grafana routes, and everything under them,
+// that change the user's current org: the API, and the UI's org
+// switcher.
+var orgSwitchPaths = []string{"/api/user/using", "/profile/switch-org"}
+
+// isOrgSwitch reports whether urlPath, once cleaned, is under one of
+// orgSwitchPaths, however it's spelled.
+func isOrgSwitch(urlPath string) bool {
+	p := strings.ToLower(path.Clean("/" + urlPath))
+	for _, sp := range orgSwitchPaths {
+		if strings.HasPrefix(p, sp+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// grafanaOrg returns the Grafana org ID from the capGrafanaOrg
+// capability in caps, or the empty string if there isn't a valid one.
+func grafanaOrg(caps []string) string {
+	q, ok := capParams(caps, capGrafanaOrg)
+	if !ok {
+		return ""
+	}
+	id := q.Get("id")
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return ""
+	}
+	return id
+}
@@ -0,0 +1,85 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestEnforceOrg(t *testing.T) {
+	defer func(v bool) { *enforceOrg = v }(*enforceOrg)
+	*enforceOrg = true
+
+	lc := localhostUser("alice@example.com", "Alice Smith")
+	lc["127.0.0.1"].Caps = []string{capGrafanaOrg + "?id=2"}
+	proxyURL, reqs := startProxy(t, lc)
+
+	r := get(t, proxyURL, "/d/abc?orgId=5", reqs, http.Header{grafanaOrgHeader: {"5"}})
+	if got := r.URL.Query().Get("orgId"); got != "2" {
+		t.Errorf("orgId = %q; want 2", got)
+	}
+	if got := r.Header.Get(grafanaOrgHeader); got != "2" {
+		t.Errorf("%s = %q; want 2", grafanaOrgHeader, got)
+	}
+
+	for _, p := range []string{"/api/user/using/5", "/profile/switch-org/5", "/profile/switch-org/5?forceLogin=true", "//api/./user/using/5", "/Profile/Switch-Org/5"} {
+		res, err := http.Post(proxyURL+p, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("switching orgs with %s: got %v; want 403", p, res.Status)
+		}
+	}
+
+	// Without the capability, Grafana picks the user's default org.
+	lc["127.0.0.1"].Caps = nil
+	r = get(t, proxyURL, "/d/abc?orgId=5", reqs, http.Header{grafanaOrgHeader: {"5"}})
+	if got := r.URL.Query().Get("orgId"); got != "" {
+		t.Errorf("orgId = %q; want none", got)
+	}
+	if got := r.Header.Get(grafanaOrgHeader); got != "" {
+		t.Errorf("%s = %q; want none", grafanaOrgHeader, got)
+	}
+}
+
+func TestIsOrgSwitch(t *testing.T) {
+	for _, tt := range []struct {
+		path string
+		want bool
+	}{
+		{"/api/user/using/2", true},
+		{"/profile/switch-org/2", true},
+		{"/api/user/../user/using/2", true},
+		{"/profile//switch-org/2", true},
+		{"/profile", false},
+		{"/profile/switch-organization", false},
+		{"/api/user", false},
+	} {
+		if got := isOrgSwitch(tt.path); got != tt.want {
+			t.Errorf("isOrgSwitch(%q) = %v; want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestGrafanaOrg(t *testing.T) {
+	tests := []struct {
+		caps []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{capGrafanaOrg + "?id=3"}, "3"},
+		{[]string{"https://tailscale.com/cap/file-sharing", capGrafanaOrg + "?id=3"}, "3"},
+		{[]string{capGrafanaOrg + "?id=abc"}, ""},
+		{[]string{capGrafanaOrg}, ""},
+		{[]string{capGrafanaOrg + "-extra?id=3"}, ""},
+	}
+	for _, tt := range tests {
+		if got := grafanaOrg(tt.caps); got != tt.want {
+			t.Errorf("grafanaOrg(%q) = %q; want %q", tt.caps, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// Headers with which, with --allow-identity-override, a request from a
+// --trusted-proxies address says who to treat it as.
+const (
+	overrideUserHeader = "X-Tailscale-Identity-Override"      // login name
+	overrideCapsHeader = "X-Tailscale-Identity-Override-Caps" // comma-separated capability URLs
+)
+
+// identityOverrideHandler returns a handler that, for requests directly
+// from one of trusted, identifies the user by the override headers, if
+// present, rather than WhoIs. The trusted proxy must set or strip them
+// on every request itself; any it passes on from its clients are
+// believed. Every handler that identifies the user, per whoIs, sees the
+// overriding identity and its capabilities, so it's for testing role and
+// org mapping in staging without a device per identity. The headers are
+// removed from all requests; modifyRequest also removes them when this
+// handler isn't in use.
+//
+// It must wrap trustedProxiesHandler, so it sees the proxy's address
+// rather than its client's.
+func identityOverrideHandler(h http.Handler, trusted prefixList) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		login := strings.TrimSpace(r.Header.Get(overrideUserHeader))
+		caps := r.Header.Get(overrideCapsHeader)
+		r.Header.Del(overrideUserHeader)
+		r.Header.Del(overrideCapsHeader)
+		if login != "" {
+			ap, err := netip.ParseAddrPort(r.RemoteAddr)
+			if err == nil && trusted.contains(ap.Addr()) {
+				ri := getRequestInfo(r.Context())
+				ri.override = overrideWhoIs(login, caps)
+				log.Printf("request %s: identity overridden to %q by %s", ri.id, login, r.RemoteAddr)
+			} else {
+				log.Printf("request %s: ignoring %s from %s, which isn't a trusted proxy", getRequestInfo(r.Context()).id, overrideUserHeader, r.RemoteAddr)
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// overrideWhoIs returns the identity asserted by the override headers.
+func overrideWhoIs(login, caps string) *apitype.WhoIsResponse {
+	res := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{Name: "identity-override", ComputedName: "identity-override"},
+		UserProfile: &tailcfg.UserProfile{
+			LoginName:   login,
+			DisplayName: login,
+		},
+	}
+	for _, c := range strings.Split(caps, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			res.Caps = append(res.Caps, c)
+		}
+	}
+	return res
+}
@@ -0,0 +1,96 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIdentityOverride(t *testing.T) {
+	defer func(v bool) { *allowOverride = v }(*allowOverride)
+	defer func(v string) { *trustedProxies = v }(*trustedProxies)
+	override := http.Header{overrideUserHeader: {"carol@example.com"}}
+
+	// Off by default.
+	proxyURL, reqs := startProxy(t, localhostUser("alice@example.com", "Alice Smith"))
+	r := get(t, proxyURL, "/login", reqs, override)
+	if got, want := r.Header.Get("X-Webauth-User"), "alice@example.com"; got != want {
+		t.Errorf("without --allow-identity-override: X-Webauth-User = %q; want %q", got, want)
+	}
+	if got := r.Header.Get(overrideUserHeader); got != "" {
+		t.Errorf("%s passed to backend: %q", overrideUserHeader, got)
+	}
+
+	// The test client, on localhost, is the trusted proxy.
+	*allowOverride = true
+	*trustedProxies = "127.0.0.1"
+	proxyURL, reqs = startProxy(t, localhostUser("alice@example.com", "Alice Smith"))
+	r = get(t, proxyURL, "/login", reqs, override)
+	if got, want := r.Header.Get("X-Webauth-User"), "carol@example.com"; got != want {
+		t.Errorf("X-Webauth-User = %q; want %q", got, want)
+	}
+	if got := r.Header.Get(overrideUserHeader); got != "" {
+		t.Errorf("%s passed to backend: %q", overrideUserHeader, got)
+	}
+}
+
+func TestIdentityOverrideSource(t *testing.T) {
+	trusted, err := parsePrefixList("10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		remoteAddr string
+		want       bool
+	}{
+		{"127.0.0.1:1234", false},
+		{"[::1]:1234", false},
+		{"10.0.0.2:1234", true},
+		{"100.64.0.1:1234", false},
+	} {
+		var got *requestInfo
+		h := withRequestInfo(identityOverrideHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = getRequestInfo(r.Context())
+		}), trusted))
+		req := httptest.NewRequest("GET", "/login", nil)
+		req.RemoteAddr = tt.remoteAddr
+		req.Header.Set(overrideUserHeader, "carol@example.com")
+		req.Header.Set(overrideCapsHeader, capGrafanaOrg+"?id=2")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if (got.override != nil) != tt.want {
+			t.Errorf("from %s: overridden = %v; want %v", tt.remoteAddr, got.override != nil, tt.want)
+			continue
+		}
+		if tt.want && grafanaOrg(got.override.Caps) != "2" {
+			t.Errorf("from %s: caps = %q; want org 2", tt.remoteAddr, got.override.Caps)
+		}
+	}
+}
+
+func TestIdentityOverrideCaps(t *testing.T) {
+	defer func(v bool) { *allowOverride = v }(*allowOverride)
+	defer func(v bool) { *enforceOrg = v }(*enforceOrg)
+	defer func(v string) { *trustedProxies = v }(*trustedProxies)
+	*allowOverride = true
+	*enforceOrg = true
+	*trustedProxies = "127.0.0.1"
+
+	// Alice has no org capability; the overriding identity does.
+	proxyURL, reqs := startProxy(t, localhostUser("alice@example.com", "Alice Smith"))
+	r := get(t, proxyURL, "/d/abc?orgId=1", reqs, http.Header{
+		overrideUserHeader: {"carol@example.com"},
+		overrideCapsHeader: {capGrafanaOrg + "?id=2"},
+	})
+	if got := r.URL.Query().Get("orgId"); got != "2" {
+		t.Errorf("orgId = %q; want 2", got)
+	}
+	if got := r.Header.Get(grafanaOrgHeader); got != "2" {
+		t.Errorf("%s = %q; want 2", grafanaOrgHeader, got)
+	}
+	if got := r.Header.Get(overrideCapsHeader); got != "" {
+		t.Errorf("%s passed to backend: %q", overrideCapsHeader, got)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+const (
+	// provisionTimeout bounds how long a single webhook POST may take.
+	provisionTimeout = 10 * time.Second
+
+	// provisionTTL is how long a user sent to the webhook isn't sent
+	// again. Users who keep coming back are re-sent once in a while, so
+	// the webhook must be idempotent, but the set of users remembered
+	// stays bounded by those seen recently.
+	provisionTTL = 24 * time.Hour
+)
+
+// provisionRequest is the JSON body POSTed to --provision-webhook.
+type provisionRequest struct {
+	LoginName     string
+	DisplayName   string
+	ProfilePicURL string   `json:",omitempty"`
+	Tags          []string `json:",omitempty"` // the node's tags, for tagged nodes
+}
+
+// provisioner sends each Tailscale user to a --provision-webhook the
+// first time it sees them, in the background, so requests never wait
+// for it. Failed sends are retried the next time the user shows up.
+type provisioner struct {
+	url string
+
+	mu   sync.Mutex
+	seen map[string]time.Time // login name => when to forget it was sent (or is being sent)
+}
+
+func newProvisioner(webhookURL string) *provisioner {
+	return &provisioner{url: webhookURL, seen: make(map[string]time.Time)}
+}
+
+// hook is a RequestHook that sends user to the webhook if it hasn't
+// been already. It never blocks.
+func (p *provisioner) hook(r *http.Request, user *tailcfg.UserProfile) error {
+	if user == nil {
+		return nil
+	}
+	login := user.LoginName
+	now := time.Now()
+	p.mu.Lock()
+	seen := now.Before(p.seen[login])
+	if !seen {
+		for k, expires := range p.seen {
+			if now.After(expires) {
+				delete(p.seen, k)
+			}
+		}
+		p.seen[login] = now.Add(provisionTTL)
+	}
+	p.mu.Unlock()
+	if seen {
+		return nil
+	}
+
+	req := provisionRequest{
+		LoginName:     login,
+		DisplayName:   user.DisplayName,
+		ProfilePicURL: user.ProfilePicURL,
+	}
+	if whois := getRequestInfo(r.Context()).whois; whois != nil && whois.Node != nil {
+		req.Tags = whois.Node.Tags
+	}
+	go func() {
+		if err := p.post(&req); err != nil {
+			log.Printf("provision webhook for %q: %v", login, err)
+			// Forget the user so we try again next time they show up.
+			p.mu.Lock()
+			delete(p.seen, login)
+			p.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+func (p *provisioner) post(pr *provisionRequest) error {
+	body, err := json.Marshal(pr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), provisionTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %v", res.Status)
+	}
+	return nil
+}
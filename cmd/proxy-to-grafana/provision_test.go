@@ -0,0 +1,113 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// provisionWebhookServer starts a fake --provision-webhook that sends
+// each request it gets to the returned channel and then replies with
+// the next status from statuses.
+func provisionWebhookServer(t *testing.T) (url string, posts <-chan provisionRequest, statuses chan<- int) {
+	t.Helper()
+	postc := make(chan provisionRequest, 10)
+	statusc := make(chan int, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var pr provisionRequest
+		if err := json.NewDecoder(r.Body).Decode(&pr); err != nil {
+			t.Errorf("decoding webhook request: %v", err)
+		}
+		postc <- pr
+		w.WriteHeader(<-statusc)
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(statusc) })
+	return srv.URL, postc, statusc
+}
+
+func TestProvisionWebhookTags(t *testing.T) {
+	defer func(v string) { *provisionWebhook = v }(*provisionWebhook)
+	defer func(v string) { *taggedPolicy = v }(*taggedPolicy)
+	*taggedPolicy = "map"
+	url, posts, statuses := provisionWebhookServer(t)
+	*provisionWebhook = url
+
+	lc := fakeWhoIs{"127.0.0.1": {
+		Node: &tailcfg.Node{Name: "ci.example.ts.net.", ComputedName: "ci", Tags: []string{"tag:ci"}},
+	}}
+	proxyURL, reqs := startProxy(t, lc)
+	get(t, proxyURL, "/login", reqs, nil)
+	statuses <- http.StatusOK
+	want := provisionRequest{LoginName: "ci@tagged.invalid", DisplayName: "ci", Tags: []string{"tag:ci"}}
+	if got := <-posts; !reflect.DeepEqual(got, want) {
+		t.Errorf("webhook got %+v; want %+v", got, want)
+	}
+}
+
+func TestProvisioner(t *testing.T) {
+	url, posts, statuses := provisionWebhookServer(t)
+	p := newProvisioner(url)
+	alice := &tailcfg.UserProfile{LoginName: "alice@example.com", DisplayName: "Alice"}
+	req := httptest.NewRequest("GET", "/login", nil)
+	req = req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, &requestInfo{
+		whois: &apitype.WhoIsResponse{Node: &tailcfg.Node{}, UserProfile: alice},
+	}))
+	seen := func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		_, ok := p.seen[alice.LoginName]
+		return ok
+	}
+
+	// The hook returns while the webhook hasn't replied yet.
+	p.hook(req, alice)
+	if got := <-posts; got.LoginName != alice.LoginName {
+		t.Errorf("webhook got %+v; want %s", got, alice.LoginName)
+	}
+	// Seeing the user again while the first send is in flight doesn't
+	// send them again.
+	p.hook(req, alice)
+
+	// The send fails, so the user is forgotten and sent again next time.
+	statuses <- http.StatusInternalServerError
+	for deadline := time.Now().Add(5 * time.Second); seen(); {
+		if time.Now().After(deadline) {
+			t.Fatal("user not forgotten after failed send")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p.hook(req, alice)
+	<-posts
+	statuses <- http.StatusOK
+
+	// After the successful send, the user isn't sent again.
+	p.hook(req, alice)
+	select {
+	case got := <-posts:
+		t.Errorf("webhook got %+v again after success", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Users are forgotten after provisionTTL, so the set stays bounded.
+	p.mu.Lock()
+	p.seen[alice.LoginName] = time.Now().Add(-time.Second)
+	p.mu.Unlock()
+	bob := &tailcfg.UserProfile{LoginName: "bob@example.com"}
+	p.hook(req, bob)
+	<-posts
+	statuses <- http.StatusOK
+	if seen() {
+		t.Error("expired user still remembered")
+	}
+}
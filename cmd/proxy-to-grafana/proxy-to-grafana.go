@@ -10,6 +10,9 @@
 //
 // Set the TS_AUTHKEY environment variable to have this server automatically
 // join your tailnet, or look for the logged auth link on first start.
+// With --ephemeral, the node is removed from the tailnet shortly after the
+// process exits; since it must then re-register on every start, pair it
+// with a reusable (and ideally ephemeral) auth key in TS_AUTHKEY.
 //
 // Use this Grafana configuration to enable the auth proxy:
 //
@@ -21,24 +24,50 @@
 //	whitelist = 127.0.0.1
 //	headers = Name:X-WEBAUTH-NAME
 //	enable_login_token = true
+//
+// With --funnel, Grafana is also reachable from the internet. Those users
+// have no Tailscale identity, so leave Grafana's login form enabled for
+// them; tailnet users are still signed in automatically.
+//
+// With --enforce-session-age, the tailnet policy file can limit how long
+// a user stays signed in, independent of Grafana's own session settings:
+// whichever of the capability's max-age and Grafana's
+// login_maximum_lifetime_duration is shorter wins. The age is tracked per
+// user, in memory, so it's shared by all of a user's browsers. Sessions
+// of unknown age, as after proxy-to-grafana restarts, are made to sign
+// in again, which starts the clock.
+//
+// Nodes shared into the tailnet are signed in as their owner in the
+// other tailnet; WhoIs marks them with a non-zero Node.Sharer. Use
+// --shared-node-policy to reject or mark their requests.
+//
+// With --identity-style, it can instead front other apps that trust a
+// reverse proxy to identify users, such as those expecting oauth2-proxy's
+// X-Forwarded-User header.
 package main
 
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"strings"
 	"time"
 
+	"golang.org/x/exp/slices"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/logtail/backoff"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tsnet"
+	"tailscale.com/types/logger"
 )
 
 var (
@@ -46,19 +75,108 @@
 	backendAddr  = flag.String("backend-addr", "", "Address of the Grafana server served over HTTP, in host:port format. Typically localhost:nnnn.")
 	tailscaleDir = flag.String("state-dir", "./", "Alternate directory to use for Tailscale state storage. If empty, a default is used.")
 	useHTTPS     = flag.Bool("use-https", false, "Serve over HTTPS via your *.ts.net subdomain if enabled in Tailscale admin.")
+	noTsnetLogs  = flag.Bool("no-tsnet-logs", false, "Don't log tsnet's verbose internal logs, only those for proxy-to-grafana and the auth URL.")
+	quiet        = flag.Bool("quiet", false, "Don't log routine startup information, such as the configuration and tailscale status, or tsnet's internal logs, only warnings and errors. The auth URL is always logged.")
+	ephemeral    = flag.Bool("ephemeral", false, "Register as an ephemeral node, removed from the tailnet soon after the process exits.")
+
+	noHTTPRedirect = flag.Bool("no-http-redirect", false, "With --use-https, don't listen on port 80 to redirect HTTP requests to HTTPS.")
+	allowedHosts   = flag.String("allowed-hosts", "", "With --use-https, comma-separated host names, such as grafana.example.ts.net, to complete TLS handshakes for; handshakes for other SNI names fail. Not supported with --funnel.")
+	logTLSSNI      = flag.Bool("log-tls-sni", false, "With --use-https, log the SNI name requested in each TLS handshake. Not supported with --funnel.")
+	sessionTickets = flag.Bool("tls-session-tickets", true, "With --use-https, let browsers resume TLS sessions using session tickets, skipping the full handshake when they reconnect. Not supported with --funnel.")
+	certFailExit   = flag.Int("exit-on-cert-failure", 0, "With --use-https, if non-zero, exit after this many consecutive failures to fetch the TLS cert for this node's HTTPS name (failures for other SNI names don't count), so a supervisor can restart the process, rather than keep failing handshakes. Not supported with --funnel.")
+	logTLSInfo     = flag.Bool("log-tls-info", false, "With --use-https, log the TLS version and ALPN protocol negotiated for each connection. Not supported with --funnel.")
+	tlsInfoHeader  = flag.String("tls-info-header", "", "If non-empty, with --use-https, header in which to send Grafana the TLS version and ALPN protocol of each request's connection, like \"TLS 1.3; alpn=h2\". Not supported with --funnel.")
+	funnel         = flag.Bool("funnel", false, "With --use-https, also serve to the public internet using Tailscale Funnel. Users without a Tailscale identity get Grafana's own login page.")
+
+	identityStyleName    = flag.String("identity-style", "grafana", "Headers with which to identify users to the backend: \"grafana\" for Grafana's auth proxy, \"oauth2-proxy\" for X-Forwarded-User and X-Forwarded-Email, or \"custom\" for <prefix>User and <prefix>Name per --identity-header-prefix. Except with \"grafana\", every request is identified, not just /login.")
+	nameTemplate         = flag.String("name-template", "", "If non-empty, Go text/template for the display name sent to the backend, with .User (the Tailscale user profile), .Node and .Tailnet; for example, \"{{.User.DisplayName}} ({{.Tailnet}})\" to tell apart users of different tailnets.")
+	identityHeaderPrefix = flag.String("identity-header-prefix", "", "With --identity-style=custom, the prefix of the identity headers, such as X-Auth-Request-.")
+	allowTagged          = flag.Bool("allow-tagged", false, "Allow tagged nodes, which otherwise aren't users, signing each one in as a Grafana user named after the node per --tagged-user-pattern. Tagged nodes have no per-person attribution: anyone using such a node is that node's Grafana user.")
+	taggedUserPattern    = flag.String("tagged-user-pattern", "{node}@tagged.invalid", "With --allow-tagged or --tagged-node-policy=map, the Grafana login name for a tagged node; {node} is replaced by the node's name. Whoever registers a node picks its name, so keep the pattern in a namespace of its own, like the default, that can't match Grafana's own or real users' accounts, such as admin. Without {node}, all tagged nodes share one service user.")
+	rejectExpired        = flag.Bool("reject-expired-nodes", false, "Reject requests with 403 Forbidden from nodes whose key has expired, in case WhoIs still knows them, rather than sign them in.")
+	sharedPolicy         = flag.String("shared-node-policy", "allow", "What to do with requests from nodes shared into the tailnet from another one: \"allow\" them like any other; \"deny\" them with 403 Forbidden; or \"tag\" them with an X-Tailscale-Shared-Node: true header, for example to map them to a different Grafana role.")
+	taggedPolicy         = flag.String("tagged-node-policy", "forward", "What to do with requests from tagged nodes, which aren't users: \"forward\" them without an identity, so Grafana shows its login page; \"deny\" them with 403 Forbidden; or \"map\" them to Grafana users per --tagged-user-pattern, like --allow-tagged.")
+	startupTimeout       = flag.Duration("startup-timeout", time.Minute, "How long to wait at startup, with --use-https, for Tailscale to be running.")
+	backendAddrFile      = flag.String("backend-addr-file", "", "If non-empty, file containing the --backend-addr to use instead. It's re-read on SIGHUP, so the backend can move without restarting the Tailscale node.")
+	backendDialAddr      = flag.String("backend-dial-addr", "", "If non-empty, host:port to connect to for the Grafana server, instead of resolving --backend-addr, which is still used as the backend's Host. For split-horizon DNS or service meshes.")
+	backendHeaderTimeout = flag.Duration("backend-header-timeout", 0, "If non-zero, how long to wait for the backend's response headers before giving up on a request.")
+	backendTimeout503    = flag.Bool("backend-header-timeout-503", false, "Reply 503 Service Unavailable, with Retry-After, rather than 502 Bad Gateway when the backend times out or can't be reached.")
+	flushInterval        = flag.Duration("flush-interval", 0, "How often to flush responses from Grafana to the client while they're being copied. Negative means after every write, so streamed responses arrive promptly at some cost in throughput for large ones. Zero is Go's default: streamed (text/event-stream or unknown-length) responses are flushed after every write, and others as the server's buffer fills.")
+	backendMaxConns      = flag.Int("backend-max-conns", 0, "If non-zero, the maximum number of connections to the Grafana backend, including idle ones. Requests beyond it wait for a connection.")
+	backendIdlePerHost   = flag.Int("backend-max-idle-conns-per-host", http.DefaultMaxIdleConnsPerHost, "Maximum number of idle keep-alive connections to keep to the Grafana backend.")
+	backendMaxIdle       = flag.Int("backend-max-idle-conns", 100, "Maximum number of idle keep-alive connections to keep to backends in total; 0 means no limit. As there's one backend, the lower of this and --backend-max-idle-conns-per-host applies.")
+	idleTimeout          = flag.Duration("idle-timeout", 120*time.Second, "How long to keep idle client keep-alive connections open.")
+	maxHeaderBytes       = flag.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size in bytes of a request's headers, including the request line.")
+	grpcBackendAddr      = flag.String("grpc-backend-addr", "", "If non-empty, address of a gRPC server, in host:port format, to which gRPC requests are proxied over cleartext HTTP/2 instead of going to --backend-addr.")
+	rendererAddr         = flag.String("renderer-addr", "", "If non-empty, address of a Grafana image renderer, in host:port format, to which requests for --renderer-path are proxied instead of going to --backend-addr.")
+	rendererPath         = flag.String("renderer-path", "/render", "With --renderer-addr, the URL path, and everything under it, to proxy to the renderer.")
+	rendererTimeout      = flag.Duration("renderer-header-timeout", 0, "With --renderer-addr, if non-zero, how long to wait for the renderer's response headers before giving up on a request. Independent of --backend-header-timeout.")
+	backendProxyProtocol = flag.Int("backend-proxy-protocol", 0, "If 1 or 2, send a PROXY protocol header of that version carrying the tailnet client's address on each backend connection. Backend connections are then not reused.")
+	perUserRPS           = flag.Float64("per-user-rps", 0, "If non-zero, the number of requests per second each Tailscale user may make before getting 429 Too Many Requests.")
+	perUserBurst         = flag.Int("per-user-burst", 50, "With --per-user-rps, the number of requests each Tailscale user may make in a burst.")
+	noAuthPaths          = flag.String("no-auth-paths", "", "With an --identity-style that identifies every request, comma-separated paths or patterns, like those of --deny-paths, whose requests are forwarded without identifying the user, saving a WhoIs call for each. For example, \"/public,/favicon.ico\".")
+	denyPaths            = flag.String("deny-paths", "", "Comma-separated URL paths to reject with 403 Forbidden, along with everything under them, or glob patterns (per Go's path.Match) to reject. For example, \"/admin,/api/admin\".")
+	enforceOrg           = flag.Bool("enforce-org", false, "Pin each user to the Grafana org ID in their https://tailscale.com/cap/grafana-org?id=N capability, or their default org if they have none, and don't let them switch orgs.")
+	enforceSessionAge    = flag.Bool("enforce-session-age", false, "Make users sign in to Grafana again once they've been signed in for longer than the max-age in their https://tailscale.com/cap/grafana-session?max-age=8h capability.")
+	clientCertHeader     = flag.String("client-cert-header", "", "If non-empty, with --use-https, accept TLS client certificates signed by --client-ca-file and send the verified certificate's subject to Grafana in this header.")
+	clientCAFile         = flag.String("client-ca-file", "", "With --client-cert-header, file of PEM-encoded CA certificates that TLS client certificates must be signed by.")
+	capHeaders           = flag.Bool("cap-headers", false, "Set an X-Tailscale-Cap-<Key> header on each request for every key=value parameter of the user's https://tailscale.com/cap/grafana-headers capability, for use by Grafana plugins.")
+	logoutOnShutdown     = flag.Bool("logout-on-shutdown", false, "On SIGINT or SIGTERM, log this node out of the tailnet rather than just stopping, so it doesn't linger in the admin console. It then needs a new auth key to start again.")
+	cacheStatic          = flag.Int64("cache-static", 0, "If non-zero, cache Grafana's static assets (under /public/) in memory, up to this many MiB, when Grafana says they're cacheable for at least an hour.")
+	whoIsConcurrency     = flag.Int("whois-concurrency", 0, "If non-zero, the maximum number of concurrent WhoIs calls to the local Tailscale daemon. Requests needing more wait up to 5s for their turn.")
+	debugPort            = flag.Int("debug-port", 0, "If non-zero, localhost port on which to serve the debug and metrics endpoints, including /debug/whoami for checking how users are identified.")
+	debugTailnet         = flag.Bool("debug-tailnet", false, "With --debug-port, serve the debug and metrics endpoints on that port on the tailnet, to --admin-users only, rather than on localhost.")
+	adminUsers           = flag.String("admin-users", "", "With --debug-tailnet, comma-separated login names of the Tailscale users allowed to use the debug and metrics endpoints.")
+	syslogOut            = flag.Bool("syslog", false, "Log to syslog instead of stderr, falling back to stderr if syslog is unavailable.")
+	syslogAddr           = flag.String("syslog-addr", "", "With --syslog, address of a remote syslog server to log to instead of the local one, as host:port for UDP or tcp://host:port for TCP.")
+	allowConnect         = flag.String("allow-connect", "", "Comma-separated host:port targets to which Tailscale users may open tunnels with HTTP CONNECT requests, as Grafana's datasource proxy sometimes needs. CONNECT requests are rejected by default.")
+	maintenance          = flag.Bool("maintenance", false, "Serve a 503 maintenance page for all requests instead of proxying to Grafana.")
+	maintenanceFile      = flag.String("maintenance-file", "", "If non-empty, serve the maintenance page while this file exists. It's checked at startup and on SIGHUP.")
+	tailnetHeader        = flag.String("tailnet-header", "", "If non-empty, header in which to send Grafana the tailnet domain (such as example.ts.net) of the node each request comes from, for multi-tailnet deployments.")
+	nodeIDHeader         = flag.String("node-id-header", "", "If non-empty, header in which to send Grafana the stable node ID of the node each request comes from, which stays the same when the node is renamed, for auditing.")
+	slowRequestThreshold = flag.Duration("slow-request-threshold", 0, "If non-zero, log a warning for each request that takes longer than this to serve.")
+	jwtHeader            = flag.String("jwt-header", "", "If non-empty, header in which to send Grafana a JWT, signed with --jwt-key-file, describing each request's Tailscale user, for plugins that authenticate with JWTs.")
+	jwtKeyFile           = flag.String("jwt-key-file", "", "With --jwt-header, file containing the PEM-encoded Ed25519, ECDSA P-256 or RSA private key to sign JWTs with.")
+	sanitizeMode         = flag.String("username-sanitize", "encode", "What to do with characters in login names, other than ASCII letters, digits and ._-@, that Grafana may not accept in usernames: \"encode\" their UTF-8 bytes as %XX, so a+b@example.com is a%2Bb@example.com; \"reject\" the sign-in; \"replace\" them with _; or \"strip\" them. Changes are logged once per login name. Replacing and stripping can turn different login names, like a+b@example.com and a_b@example.com, into the same Grafana user, so only use them if your tailnet's login names can't collide that way.")
+	maxControlSilence    = flag.Duration("max-control-silence", 0, "If non-zero, reject requests with 503 Service Unavailable while the node has been out of contact with Tailscale's control server for longer than this, including since startup, as during a long control outage, rather than identify users from stale data. Contact is checked every 30s, so this must be at least that.")
+	userMapURL           = flag.String("user-map-url", "", "If non-empty, URL of a service that translates Tailscale login names into Grafana usernames. It's sent GET requests with the login name in the \"login\" query parameter, or per --map-by the user ID in \"id\", and must reply with JSON like {\"Username\": \"alice\"}.")
+	mapBy                = flag.String("map-by", "login", "With --user-map-url, how to identify users to it: \"login\" for their login name, or \"id\" for their Tailscale user ID, which stays the same if their login name changes. Grafana still gets the username the service replies with, so it should be stable too.")
+	userMapDeny          = flag.Bool("user-map-deny", false, "With --user-map-url, reject sign-ins whose Grafana username can't be looked up, rather than using their Tailscale login name.")
+	minClientVersion     = flag.String("min-client-version", "", "If non-empty, the oldest Tailscale version, like 1.38.0, that nodes may run to use Grafana. Nodes that don't report their version are allowed.")
+	trustedProxies       = flag.String("trusted-proxies", "", "Comma-separated IPs or CIDR prefixes of reverse proxies in front of proxy-to-grafana. For requests from them, users are identified by the X-Forwarded-For address they add.")
+	localAddr            = flag.String("local-addr", "", "If non-empty, loopback host:port, such as 127.0.0.1:8080, on which to also serve over plain HTTP outside the tailnet, for local health checks. WhoIs can't identify its users, who are signed in as --loopback-user, if set, or else not at all.")
+	loopbackUser         = flag.String("loopback-user", "", "With --local-addr, login name as which to sign in its connections, such as local health checks. Tailnet connections are identified as usual.")
+	allowOverride        = flag.Bool("allow-identity-override", false, "FOR TESTING ONLY: with --trusted-proxies, let requests from those proxies claim to be any user, bypassing WhoIs, with the X-Tailscale-Identity-Override header (a login name) and optionally X-Tailscale-Identity-Override-Caps (comma-separated capabilities). The proxies must set or strip both headers on every request themselves, never passing on their clients'. Not supported with --funnel.")
+	userAgent            = flag.String("user-agent", "", "If non-empty, the User-Agent to send Grafana instead of the client's, in which {client} is replaced by the client's User-Agent and {version} by proxy-to-grafana's version; for example, \"tailscale-grafana-proxy/{version} {client}\".")
+	traceContext         = flag.Bool("trace-context", false, "Add the proxy as a hop to the W3C Trace Context (traceparent) of each request to Grafana, starting a new trace if there isn't one, so traces in Grafana Tempo and the like begin at the proxy.")
+	headerRulesFile      = flag.String("header-rules", "", "If non-empty, file of rules for setting, adding, removing and renaming headers of requests to Grafana and its responses, one per line like \"request set X-Scope-OrgID 1\" or \"response remove Server\". It's re-read on SIGHUP.")
+	provisionWebhook     = flag.String("provision-webhook", "", "If non-empty, URL to POST a JSON description of each Tailscale user (login name, display name, profile picture and, for tagged nodes, tags) to the first time they're seen, or first in a day, so external tooling can pre-create their Grafana account.")
 )
 
 func main() {
 	flag.Parse()
-	if *hostname == "" || strings.Contains(*hostname, ".") {
-		log.Fatal("missing or invalid --hostname")
+	if err := validateFlags(); err != nil {
+		log.Fatal(err)
 	}
-	if *backendAddr == "" {
-		log.Fatal("missing --backend-addr")
+	if *syslogOut {
+		useSyslog()
+	}
+	logConfig()
+	if *sanitizeMode == "replace" || *sanitizeMode == "strip" {
+		log.Printf("WARNING: --username-sanitize=%s can sign different Tailscale users in as the same Grafana user, if their login names differ only in characters that get changed.", *sanitizeMode)
+	}
+	if *allowOverride {
+		log.Printf("WARNING: --allow-identity-override is set: requests from --trusted-proxies can claim to be any user with the %s header. Never use this in production.", overrideUserHeader)
 	}
 	ts := &tsnet.Server{
-		Dir:      *tailscaleDir,
-		Hostname: *hostname,
+		Dir:       *tailscaleDir,
+		Hostname:  *hostname,
+		Ephemeral: *ephemeral,
+		// Always show the auth URL, however quiet tsnet is otherwise.
+		UserLogf: log.Printf,
+	}
+	if *noTsnetLogs || *quiet {
+		ts.Logf = logger.Discard
 	}
 
 	// TODO(bradfitz,maisem): move this to a method on tsnet.Server probably.
@@ -67,92 +185,422 @@ func main() {
 	}
 	localClient, _ := ts.LocalClient()
 
-	url, err := url.Parse(fmt.Sprintf("http://%s", *backendAddr))
+	addr := *backendAddr
+	if *backendAddrFile != "" {
+		var err error
+		if addr, err = readBackendAddrFile(); err != nil {
+			log.Fatalf("couldn't read --backend-addr-file: %v", err)
+		}
+	}
+	url, err := backendURL(addr)
 	if err != nil {
 		log.Fatalf("couldn't parse backend address: %v", err)
 	}
+	backend := newBackendTarget(url)
+	if *backendAddrFile != "" {
+		go reloadBackendOnSignal(backend)
+	}
 
-	proxy := httputil.NewSingleHostReverseProxy(url)
-	originalDirector := proxy.Director
-	proxy.Director = func(req *http.Request) {
-		originalDirector(req)
-		modifyRequest(req, localClient)
+	if *headerRulesFile != "" {
+		if err := loadHeaderRules(); err != nil {
+			log.Fatal(err)
+		}
+		go reloadHeaderRulesOnSignal()
 	}
 
-	var ln net.Listener
+	updateMaintenance()
+	if *maintenanceFile != "" {
+		go watchMaintenanceFile()
+	}
+
+	go watchBackendState(localClient)
+
+	var lc whoIsClient = localClient
+	if *whoIsConcurrency > 0 {
+		lc = newLimitedWhoIs(localClient, *whoIsConcurrency)
+	}
+	var auxServers []*http.Server // shut down along with the main one
+	if *debugPort != 0 {
+		auxServers = append(auxServers, startDebug(ts, *debugPort, lc))
+	}
+	handler, err := newHandler(backend, lc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *localAddr != "" {
+		auxServers = append(auxServers, startLocal(*localAddr, handler))
+	}
+
+	// With HTTPS, resolve our cert name up front, so a misconfiguration
+	// is caught right away rather than by the first TLS handshake.
+	var certName string
 	if *useHTTPS {
-		ln, err = ts.Listen("tcp", ":443")
-		ln = tls.NewListener(ln, &tls.Config{
-			GetCertificate: localClient.GetCertificate,
-		})
-
-		go func() {
-			// wait for tailscale to start before trying to fetch cert names
-			for i := 0; i < 60; i++ {
-				st, err := localClient.Status(context.Background())
-				if err != nil {
-					log.Printf("error retrieving tailscale status; retrying: %v", err)
-				} else {
-					log.Printf("tailscale status: %v", st.BackendState)
-					if st.BackendState == "Running" {
-						break
-					}
-				}
-				time.Sleep(time.Second)
-			}
+		// Wait for tailscale to start before trying to fetch cert names.
+		waitRunning(localClient)
+		var ok bool
+		certName, ok = localClient.ExpandSNIName(context.Background(), *hostname)
+		if !ok {
+			log.Fatalf("can't get HTTPS cert name for %q; is HTTPS enabled for your tailnet?", *hostname)
+		}
+		infof("serving HTTPS as %s", certName)
+	}
 
-			l80, err := ts.Listen("tcp", ":80")
+	var ln net.Listener
+	if *useHTTPS {
+		if *funnel {
+			// ListenFunnel serves the tailnet too, and does its own TLS.
+			ln, err = ts.ListenFunnel("tcp", ":443")
+		} else {
+			var tlsConfig *tls.Config
+			tlsConfig, err = newTLSConfig(localClient, certName)
 			if err != nil {
 				log.Fatal(err)
 			}
-			name, ok := localClient.ExpandSNIName(context.Background(), *hostname)
-			if !ok {
-				log.Fatalf("can't get hostname for https redirect")
-			}
-			if err := http.Serve(l80, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				http.Redirect(w, r, fmt.Sprintf("https://%s", name), http.StatusMovedPermanently)
-			})); err != nil {
-				log.Fatal(err)
+			ln, err = ts.Listen("tcp", ":443")
+			if err == nil {
+				ln = tls.NewListener(ln, tlsConfig)
 			}
-		}()
+		}
+
+		if !*noHTTPRedirect {
+			auxServers = append(auxServers, startHTTPRedirect(ts, certName))
+		}
 	} else {
 		ln, err = ts.Listen("tcp", ":80")
 	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("proxy-to-grafana running at %v, proxying to %v", ln.Addr(), *backendAddr)
-	log.Fatal(http.Serve(ln, proxy))
+	infof("proxy-to-grafana running at %v, proxying to %v", ln.Addr(), backend.url.Load().Host)
+	if *grpcBackendAddr != "" && !*useHTTPS {
+		// gRPC needs HTTP/2, which without TLS means h2c.
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	srv := &http.Server{
+		Handler:        handler,
+		MaxHeaderBytes: *maxHeaderBytes,
+		IdleTimeout:    *idleTimeout,
+	}
+	if *logTLSInfo {
+		srv.ConnState = tlsInfoLogger()
+	}
+	done := make(chan struct{})
+	go shutdownOnSignal(append([]*http.Server{srv}, auxServers...), ts, localClient, done)
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+}
+
+// whoIsClient is the part of *tailscale.LocalClient used to identify
+// users. It's an interface so tests can fake it.
+type whoIsClient interface {
+	WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
 }
 
-func modifyRequest(req *http.Request, localClient *tailscale.LocalClient) {
+// newHandler returns the handler that serves proxy-to-grafana's
+// traffic, proxying to the Grafana server at backend. The given hooks
+// run after defaultHooks.
+func newHandler(backend *backendTarget, lc whoIsClient, hooks ...RequestHook) (http.Handler, error) {
+	if _, err := currentIdentityStyle(); err != nil {
+		return nil, err
+	}
+	proxy := &httputil.ReverseProxy{Director: backend.direct}
+	proxy.Transport = newBackendTransport()
+	proxy.FlushInterval = *flushInterval
+	if *backendTimeout503 {
+		proxy.ErrorHandler = backendErrorHandler
+	}
+	if *headerRulesFile != "" {
+		proxy.Director = func(r *http.Request) {
+			backend.direct(r)
+			applyHeaderRules(r.Header, false)
+		}
+	}
+	if *userAgent != "" {
+		direct := proxy.Director
+		proxy.Director = func(r *http.Request) {
+			direct(r)
+			setUserAgent(r.Header, *userAgent)
+		}
+	}
+	if *traceContext {
+		direct := proxy.Director
+		proxy.Director = func(r *http.Request) {
+			direct(r)
+			propagateTraceContext(r.Header)
+		}
+	}
+	proxy.ModifyResponse = func(res *http.Response) error {
+		applyHeaderRules(res.Header, true)
+		ri := getRequestInfo(res.Request.Context())
+		if ri.whoIsErr != nil {
+			log.Printf("request %s: backend returned %v for %s %s from %s after WhoIs failure: %v", ri.id, res.Status, res.Request.Method, res.Request.URL.Path, res.Request.RemoteAddr, ri.whoIsErr)
+		}
+		return nil
+	}
+	var handler http.Handler = proxy
+	if *grpcBackendAddr != "" {
+		handler = grpcRouter(handler, newGRPCProxy(*grpcBackendAddr))
+	}
+	if *rendererAddr != "" {
+		paths, err := parsePathPatterns(*rendererPath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --renderer-path: %w", err)
+		}
+		handler = pathRouter(handler, newRendererProxy(*rendererAddr), paths)
+	}
+	defaults := slices.Clone(defaultHooks)
+	if *provisionWebhook != "" {
+		defaults = append(defaults, newProvisioner(*provisionWebhook).hook)
+	}
+	hooks = append(defaults, hooks...)
+	if *userMapURL != "" {
+		hooks = []RequestHook{newUserMapper(*userMapURL).hook(hooks)}
+	}
+	noAuth, err := parsePathPatterns(*noAuthPaths)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --no-auth-paths: %w", err)
+	}
+	handler = hooksHandler(handler, lc, hooks, noAuth)
+	if *cacheStatic > 0 {
+		handler = staticCacheHandler(handler, newStaticCache(*cacheStatic<<20))
+	}
+	if *allowConnect != "" {
+		targets, err := parseConnectTargets(*allowConnect)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --allow-connect: %w", err)
+		}
+		handler = connectHandler(handler, lc, targets)
+	}
+	if *backendProxyProtocol != 0 {
+		handler = withClientAddr(handler)
+	}
+	if *enforceOrg {
+		handler = enforceOrgHandler(handler, lc)
+	}
+	if *enforceSessionAge {
+		handler = sessionAgeHandler(handler, lc, &sessionStarts{})
+	}
+	if *capHeaders {
+		handler = capHeadersHandler(handler, lc)
+	}
+	if *tailnetHeader != "" {
+		handler = tailnetHeaderHandler(handler, lc, *tailnetHeader)
+	}
+	if *nodeIDHeader != "" {
+		handler = nodeIDHeaderHandler(handler, lc, *nodeIDHeader)
+	}
+	if *jwtHeader != "" {
+		signer, err := loadJWTSigner(*jwtKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --jwt-key-file: %w", err)
+		}
+		handler = jwtHandler(handler, lc, *jwtHeader, *hostname, signer)
+	}
+	if *clientCertHeader != "" {
+		handler = clientCertHandler(handler, *clientCertHeader)
+	}
+	if *tlsInfoHeader != "" {
+		handler = tlsInfoHandler(handler, *tlsInfoHeader)
+	}
+	if *taggedPolicy == "deny" {
+		handler = denyTaggedHandler(handler, lc)
+	}
+	if *rejectExpired {
+		handler = rejectExpiredHandler(handler, lc)
+	}
+	if *sharedPolicy != "allow" {
+		handler = sharedNodeHandler(handler, lc, *sharedPolicy)
+	}
+	if *minClientVersion != "" {
+		handler = minVersionHandler(handler, lc, *minClientVersion)
+	}
+	if *perUserRPS > 0 {
+		handler = rateLimitHandler(handler, lc, newUserLimiters(*perUserRPS, *perUserBurst))
+	}
+	if *denyPaths != "" {
+		deny, err := parsePathPatterns(*denyPaths)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --deny-paths: %w", err)
+		}
+		handler = denyPathsHandler(handler, deny)
+	}
+	if *maintenance || *maintenanceFile != "" {
+		handler = maintenanceHandler(handler)
+	}
+	if *maxControlSilence > 0 {
+		handler = controlSilenceHandler(handler, *maxControlSilence)
+	}
+	if *slowRequestThreshold > 0 {
+		handler = slowRequestHandler(handler, lc, *slowRequestThreshold)
+	}
+	trusted, err := parsePrefixList(*trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --trusted-proxies: %w", err)
+	}
+	if len(trusted) > 0 {
+		handler = trustedProxiesHandler(handler, trusted)
+	}
+	if *allowOverride {
+		handler = identityOverrideHandler(handler, trusted)
+	}
+	return withRequestInfo(handler), nil
+}
+
+// infof logs routine startup information, unless --quiet.
+func infof(format string, args ...any) {
+	if !*quiet {
+		log.Printf(format, args...)
+	}
+}
+
+// waitRunning waits for tailscale to be running, or --startup-timeout,
+// whichever comes first. It polls with jittered backoff so that many
+// proxies starting at once don't poll in lockstep.
+func waitRunning(localClient *tailscale.LocalClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), *startupTimeout)
+	defer cancel()
+	bo := backoff.NewBackoff("waitRunning", log.Printf, 5*time.Second)
+	bo.LogLongerThan = time.Hour // we log each attempt ourselves
+	for ctx.Err() == nil {
+		st, err := localClient.Status(ctx)
+		if err != nil {
+			log.Printf("error retrieving tailscale status; retrying: %v", err)
+		} else {
+			infof("tailscale status: %v", st.BackendState)
+			if st.BackendState == "Running" {
+				return
+			}
+			err = errors.New("not running")
+		}
+		bo.BackOff(ctx, err)
+	}
+	log.Printf("tailscale not running after %v", *startupTimeout)
+}
+
+// startHTTPRedirect starts serving redirects to the HTTPS site at
+// certName on port 80. It returns the server, for shutting down.
+func startHTTPRedirect(ts *tsnet.Server, certName string) *http.Server {
+	l80, err := ts.Listen("tcp", ":80")
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, fmt.Sprintf("https://%s", certName), http.StatusMovedPermanently)
+	})}
+	go serveUntilShutdown(srv, l80)
+	return srv
+}
+
+// serveUntilShutdown serves srv on ln, exiting the process if that fails
+// for any reason but srv being shut down.
+func serveUntilShutdown(srv *http.Server, ln net.Listener) {
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// modifyRequest prepares req to be forwarded to Grafana, identifying its
+// Tailscale user and running hooks on it, unless its path matches
+// noAuth. It returns the first error from a hook.
+func modifyRequest(req *http.Request, lc whoIsClient, hooks []RequestHook, noAuth pathPatterns) error {
+	// Never trust identity headers from the client; Grafana would
+	// log them in as whoever they claim to be.
+	style := mustIdentityStyle()
+	for _, h := range style.headers() {
+		req.Header.Del(h)
+	}
+	req.Header.Del(overrideUserHeader)
+	req.Header.Del(overrideCapsHeader)
+
 	// with enable_login_token set to true, we get a cookie that handles
 	// auth for paths that are not /login
-	if req.URL.Path != "/login" {
-		return
+	if style.loginOnly && req.URL.Path != "/login" {
+		return nil
+	}
+	if noAuth.match(req.URL.Path) {
+		return nil
 	}
 
-	user, err := getTailscaleUser(req.Context(), localClient, req.RemoteAddr)
+	ri := getRequestInfo(req.Context())
+	var user *tailcfg.UserProfile
+	whois, err := getTailscaleUser(req.Context(), lc, req.RemoteAddr)
 	if err != nil {
-		log.Printf("error getting Tailscale user: %v", err)
-		return
+		// With --funnel, this is most likely a user from the internet,
+		// who has no Tailscale identity. Forwarding without identity
+		// headers has Grafana show its normal login form.
+		if !*funnel {
+			ri.whoIsErr = err
+			log.Printf("request %s: error getting Tailscale user for %s: %v", ri.id, req.RemoteAddr, err)
+		}
+	} else {
+		ri.whois = whois
+		user = whois.UserProfile
 	}
 
-	req.Header.Set("X-Webauth-User", user.LoginName)
-	req.Header.Set("X-Webauth-Name", user.DisplayName)
+	for _, hook := range hooks {
+		if err := hook(req, user); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func getTailscaleUser(ctx context.Context, localClient *tailscale.LocalClient, ipPort string) (*tailcfg.UserProfile, error) {
-	whois, err := localClient.WhoIs(ctx, ipPort)
+// getTailscaleUser identifies the Tailscale user at ipPort, per whoIs.
+// It returns the full WhoIs response, with the node and its
+// capabilities, but with UserProfile replaced by the user to sign in as,
+// which for a tagged node (with --allow-tagged or
+// --tagged-node-policy=map) is named after the node.
+func getTailscaleUser(ctx context.Context, lc whoIsClient, ipPort string) (*apitype.WhoIsResponse, error) {
+	whois, err := whoIs(ctx, lc, ipPort)
 	if err != nil {
 		return nil, fmt.Errorf("failed to identify remote host: %w", err)
 	}
 	if whois.Node.IsTagged() {
-		return nil, fmt.Errorf("tagged nodes are not users")
+		if !mapTagged() {
+			return nil, fmt.Errorf("tagged nodes are not users")
+		}
+		user, err := taggedNodeUser(whois.Node)
+		if err != nil {
+			return nil, err
+		}
+		tagged := *whois
+		tagged.UserProfile = user
+		return &tagged, nil
 	}
 	if whois.UserProfile == nil || whois.UserProfile.LoginName == "" {
 		return nil, fmt.Errorf("failed to identify remote user")
 	}
 
-	return whois.UserProfile, nil
+	return whois, nil
+}
+
+// loopbackWhoIs returns the identity, per --loopback-user, of
+// connections to --local-addr.
+func loopbackWhoIs() *apitype.WhoIsResponse {
+	return &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{Name: "localhost", ComputedName: "localhost"},
+		UserProfile: &tailcfg.UserProfile{
+			LoginName:   *loopbackUser,
+			DisplayName: *loopbackUser,
+		},
+	}
+}
+
+// taggedNodeUser returns the user profile to sign a tagged node in as,
+// named after the node per --tagged-user-pattern. It fails for nodes
+// without a name, rather than sign them in as the bare pattern.
+func taggedNodeUser(n *tailcfg.Node) (*tailcfg.UserProfile, error) {
+	name := n.ComputedName
+	if name == "" && n.Hostinfo.Valid() {
+		name = n.Hostinfo.Hostname()
+	}
+	if name == "" {
+		return nil, fmt.Errorf("tagged node %v has no name to sign in as", n.StableID)
+	}
+	return &tailcfg.UserProfile{
+		LoginName:   strings.ReplaceAll(*taggedUserPattern, "{node}", name),
+		DisplayName: name,
+	}, nil
 }
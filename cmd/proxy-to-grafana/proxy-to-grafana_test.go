@@ -0,0 +1,344 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// fakeWhoIs is a whoIsClient that identifies connections by their
+// remote IP address.
+type fakeWhoIs map[string]*apitype.WhoIsResponse
+
+func (f fakeWhoIs) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	if res, ok := f[ip]; ok {
+		return res, nil
+	}
+	return nil, errors.New("no match for IP")
+}
+
+// localhostUser returns a fakeWhoIs that identifies connections from
+// localhost (where test clients connect from) as the given user.
+func localhostUser(login, name string) fakeWhoIs {
+	return fakeWhoIs{
+		"127.0.0.1": {
+			Node:        &tailcfg.Node{ID: 1, StableID: "nLaptop1CNTRL", Name: "laptop.example.ts.net."},
+			UserProfile: &tailcfg.UserProfile{ID: 2, LoginName: login, DisplayName: name},
+		},
+	}
+}
+
+// startProxy starts a fake Grafana backend and a proxy-to-grafana
+// handler in front of it using lc to identify users. It returns the
+// proxy's URL and a channel that receives each request the backend gets.
+func startProxy(t *testing.T, lc whoIsClient, hooks ...RequestHook) (proxyURL string, backendReqs <-chan *http.Request) {
+	t.Helper()
+	reqs := make(chan *http.Request, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs <- r
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(backend.Close)
+	u, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := newHandler(newBackendTarget(u), lc, hooks...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(h)
+	t.Cleanup(proxy.Close)
+	return proxy.URL, reqs
+}
+
+// get makes a GET request for path through the proxy at proxyURL with
+// the given extra headers, and returns the request the backend saw.
+func get(t *testing.T, proxyURL, path string, reqs <-chan *http.Request, hdr http.Header) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest("GET", proxyURL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, vv := range hdr {
+		req.Header[k] = vv
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %v", path, res.Status)
+	}
+	select {
+	case r := <-reqs:
+		return r
+	default:
+		t.Fatalf("GET %s: request didn't reach backend", path)
+		return nil
+	}
+}
+
+func TestProxyIdentityHeaders(t *testing.T) {
+	proxyURL, reqs := startProxy(t, localhostUser("alice@example.com", "Alice Smith"))
+
+	r := get(t, proxyURL, "/login", reqs, nil)
+	if got, want := r.Header.Get("X-Webauth-User"), "alice@example.com"; got != want {
+		t.Errorf("X-Webauth-User = %q; want %q", got, want)
+	}
+	if got, want := r.Header.Get("X-Webauth-Name"), "Alice Smith"; got != want {
+		t.Errorf("X-Webauth-Name = %q; want %q", got, want)
+	}
+
+	// Other paths rely on Grafana's login token cookie.
+	r = get(t, proxyURL, "/d/abc", reqs, nil)
+	if got := r.Header.Get("X-Webauth-User"); got != "" {
+		t.Errorf("X-Webauth-User on /d/abc = %q; want empty", got)
+	}
+}
+
+func TestProxyStripsClientIdentityHeaders(t *testing.T) {
+	proxyURL, reqs := startProxy(t, fakeWhoIs{})
+	spoofed := http.Header{
+		"X-Webauth-User": {"admin"},
+		"X-Webauth-Name": {"Admin"},
+	}
+	for _, path := range []string{"/login", "/api/dashboards"} {
+		r := get(t, proxyURL, path, reqs, spoofed)
+		if got := r.Header.Get("X-Webauth-User"); got != "" {
+			t.Errorf("%s: X-Webauth-User = %q; want empty", path, got)
+		}
+		if got := r.Header.Get("X-Webauth-Name"); got != "" {
+			t.Errorf("%s: X-Webauth-Name = %q; want empty", path, got)
+		}
+	}
+}
+
+func TestTaggedNodeRejected(t *testing.T) {
+	lc := fakeWhoIs{
+		"127.0.0.1": {
+			Node:        &tailcfg.Node{ID: 1, ComputedName: "kiosk", Tags: []string{"tag:kiosk"}},
+			UserProfile: &tailcfg.UserProfile{ID: 3, LoginName: "tagged-devices", DisplayName: "Tagged Devices"},
+		},
+	}
+	if whois, err := getTailscaleUser(context.Background(), lc, "127.0.0.1:1234"); err == nil {
+		t.Errorf("getTailscaleUser for tagged node = %v; want error", whois.UserProfile)
+	}
+
+	proxyURL, reqs := startProxy(t, lc)
+	r := get(t, proxyURL, "/login", reqs, nil)
+	for _, h := range []string{"X-Webauth-User", "X-Webauth-Name"} {
+		if got := r.Header.Get(h); got != "" {
+			t.Errorf("%s for tagged node = %q; want empty", h, got)
+		}
+	}
+}
+
+func TestAllowTagged(t *testing.T) {
+	defer func(v bool, p string) { *allowTagged, *taggedUserPattern = v, p }(*allowTagged, *taggedUserPattern)
+	*allowTagged = true
+	*taggedUserPattern = "{node}@tagged.example.com"
+
+	lc := fakeWhoIs{
+		"127.0.0.1": {
+			Node: &tailcfg.Node{
+				ID:           1,
+				ComputedName: "kiosk",
+				Tags:         []string{"tag:kiosk"},
+			},
+			UserProfile: &tailcfg.UserProfile{ID: 3, LoginName: "tagged-devices", DisplayName: "Tagged Devices"},
+		},
+	}
+	var hookNode *tailcfg.Node
+	proxyURL, reqs := startProxy(t, lc, func(r *http.Request, user *tailcfg.UserProfile) error {
+		hookNode = getRequestInfo(r.Context()).whois.Node
+		return nil
+	})
+	r := get(t, proxyURL, "/login", reqs, nil)
+	if got, want := r.Header.Get("X-Webauth-User"), "kiosk@tagged.example.com"; got != want {
+		t.Errorf("X-Webauth-User = %q; want %q", got, want)
+	}
+	if got, want := r.Header.Get("X-Webauth-Name"), "kiosk"; got != want {
+		t.Errorf("X-Webauth-Name = %q; want %q", got, want)
+	}
+	if hookNode == nil || hookNode.ComputedName != "kiosk" {
+		t.Errorf("hook got node %v; want kiosk", hookNode)
+	}
+	if got := lc["127.0.0.1"].UserProfile.LoginName; got != "tagged-devices" {
+		t.Errorf("WhoIs response modified: LoginName = %q", got)
+	}
+}
+
+func TestLoopbackUser(t *testing.T) {
+	defer func(v string) { *loopbackUser = v }(*loopbackUser)
+	*loopbackUser = "healthcheck"
+
+	// Tailnet connections, even from loopback addresses, don't get it.
+	lc := localhostUser("alice@example.com", "Alice Smith")
+	proxyURL, reqs := startProxy(t, lc)
+	r := get(t, proxyURL, "/login", reqs, nil)
+	if got, want := r.Header.Get("X-Webauth-User"), "alice@example.com"; got != want {
+		t.Errorf("tailnet: X-Webauth-User = %q; want %q", got, want)
+	}
+
+	// Connections to --local-addr do, without asking WhoIs.
+	localReqs := make(chan *http.Request, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		localReqs <- r
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := newHandler(newBackendTarget(u), fakeWhoIs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newLocalServer(h)
+	go srv.Serve(ln)
+	defer srv.Close()
+	localURL := "http://" + ln.Addr().String()
+
+	r = get(t, localURL, "/login", localReqs, nil)
+	if got, want := r.Header.Get("X-Webauth-User"), "healthcheck"; got != want {
+		t.Errorf("local: X-Webauth-User = %q; want %q", got, want)
+	}
+
+	*loopbackUser = ""
+	r = get(t, localURL, "/login", localReqs, nil)
+	if got := r.Header.Get("X-Webauth-User"); got != "" {
+		t.Errorf("local without --loopback-user: X-Webauth-User = %q; want empty", got)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	proxyURL, reqs := startProxy(t, fakeWhoIs{})
+	r := get(t, proxyURL, "/login", reqs, http.Header{requestIDHeader: {"spoofed"}})
+	id := r.Header.Get(requestIDHeader)
+	if id == "" || id == "spoofed" {
+		t.Errorf("%s = %q; want a new ID", requestIDHeader, id)
+	}
+}
+
+func TestRequestHooks(t *testing.T) {
+	var hookUser *tailcfg.UserProfile
+	proxyURL, reqs := startProxy(t, localhostUser("alice@example.com", "Alice Smith"),
+		func(r *http.Request, user *tailcfg.UserProfile) error {
+			hookUser = user
+			if r.URL.Query().Has("deny") {
+				return &HookError{Status: http.StatusTeapot, Err: errors.New("denied")}
+			}
+			r.Header.Set("X-Custom", "yes")
+			return nil
+		})
+
+	r := get(t, proxyURL, "/login", reqs, nil)
+	if hookUser == nil || hookUser.LoginName != "alice@example.com" {
+		t.Errorf("hook got user %v; want alice@example.com", hookUser)
+	}
+	if got := r.Header.Get("X-Custom"); got != "yes" {
+		t.Errorf("X-Custom = %q; want yes", got)
+	}
+	// The default hooks ran first.
+	if got := r.Header.Get("X-Webauth-User"); got != "alice@example.com" {
+		t.Errorf("X-Webauth-User = %q; want alice@example.com", got)
+	}
+
+	res, err := http.Get(proxyURL + "/login?deny")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTeapot {
+		t.Errorf("denied request: got %v; want 418", res.Status)
+	}
+	if len(reqs) != 0 {
+		t.Error("denied request reached backend")
+	}
+}
+
+func TestDenyPaths(t *testing.T) {
+	defer func(v string) { *denyPaths = v }(*denyPaths)
+	*denyPaths = "/admin,/api/admin"
+
+	proxyURL, reqs := startProxy(t, fakeWhoIs{})
+	for _, path := range []string{"/admin", "/api/admin/users", "/API//admin"} {
+		res, err := http.Get(proxyURL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("GET %s: got %v; want 403", path, res.Status)
+		}
+	}
+	if len(reqs) != 0 {
+		t.Error("denied request reached backend")
+	}
+	get(t, proxyURL, "/administrator", reqs, nil)
+}
+
+func TestMaintenance(t *testing.T) {
+	defer func(v bool) { *maintenance = v }(*maintenance)
+	*maintenance = true
+	defer inMaintenance.Store(false)
+	updateMaintenance()
+
+	proxyURL, reqs := startProxy(t, localhostUser("alice@example.com", "Alice Smith"))
+	res, err := http.Get(proxyURL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("in maintenance: got %v; want 503", res.Status)
+	}
+	if len(reqs) != 0 {
+		t.Error("request reached backend during maintenance")
+	}
+
+	*maintenance = false
+	updateMaintenance()
+	get(t, proxyURL, "/login", reqs, nil)
+}
+
+func TestWhoIsFailureLogsAddr(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	proxyURL, reqs := startProxy(t, fakeWhoIs{})
+	get(t, proxyURL, "/login", reqs, nil)
+	for _, want := range []string{
+		"error getting Tailscale user for 127.0.0.1:",
+		"from 127.0.0.1:",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log doesn't contain %q; log is %q", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+type clientAddrKey struct{}
+
+// withClientAddr returns a handler that records the request's RemoteAddr
+// in its context, so it's available to the backend dialer.
+func withClientAddr(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+			r = r.WithContext(context.WithValue(r.Context(), clientAddrKey{}, ap))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// useProxyProtocol makes tr send a PROXY protocol header of the given
+// version (1 or 2) at the start of every backend connection, describing
+// the tailnet client that the request came from.
+//
+// The client address is read from the request context, so the handler
+// must be wrapped with withClientAddr. Because a PROXY header describes
+// exactly one client, backend connections are never reused between
+// requests.
+func useProxyProtocol(tr *http.Transport, version int) {
+	dial := tr.DialContext
+	tr.DisableKeepAlives = true
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		src, _ := ctx.Value(clientAddrKey{}).(netip.AddrPort)
+		dst, _ := netip.ParseAddrPort(c.RemoteAddr().String())
+		if _, err := c.Write(proxyProtocolHeader(version, src, dst)); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("writing PROXY protocol header: %w", err)
+		}
+		return c, nil
+	}
+}
+
+// proxyProtocolV2Sig is the signature that starts every PROXY protocol
+// v2 header.
+const proxyProtocolV2Sig = "\r\n\r\n\x00\r\nQUIT\n"
+
+// proxyProtocolHeader returns the PROXY protocol header of the given
+// version for a TCP connection from src to dst. If either address is
+// invalid, the header says the source is unknown.
+//
+// See https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt.
+func proxyProtocolHeader(version int, src, dst netip.AddrPort) []byte {
+	known := src.IsValid() && dst.IsValid()
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	if known && srcIP.Is4() != dstIP.Is4() {
+		// Both ends must be the same family; fall back to
+		// IPv4-mapped IPv6 for the IPv4 one.
+		srcIP = netip.AddrFrom16(srcIP.As16())
+		dstIP = netip.AddrFrom16(dstIP.As16())
+	}
+
+	if version == 1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		fam := "TCP6"
+		if srcIP.Is4() {
+			fam = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", fam, srcIP, dstIP, src.Port(), dst.Port()))
+	}
+
+	b := []byte(proxyProtocolV2Sig)
+	if !known {
+		// LOCAL command, unspecified family, no addresses.
+		return append(b, 0x20, 0x00, 0, 0)
+	}
+	var addrs []byte
+	if srcIP.Is4() {
+		b = append(b, 0x21, 0x11) // PROXY command; TCP over IPv4
+		s, d := srcIP.As4(), dstIP.As4()
+		addrs = append(append(addrs, s[:]...), d[:]...)
+	} else {
+		b = append(b, 0x21, 0x21) // PROXY command; TCP over IPv6
+		s, d := srcIP.As16(), dstIP.As16()
+		addrs = append(append(addrs, s[:]...), d[:]...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, dst.Port())
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addrs)))
+	return append(b, addrs...)
+}
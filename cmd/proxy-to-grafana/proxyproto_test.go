@@ -0,0 +1,65 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	v4src := netip.MustParseAddrPort("100.101.102.103:51234")
+	v4dst := netip.MustParseAddrPort("127.0.0.1:3000")
+	v6dst := netip.MustParseAddrPort("[::1]:3000")
+
+	tests := []struct {
+		name     string
+		version  int
+		src, dst netip.AddrPort
+		want     string
+	}{
+		{
+			name:    "v1-ipv4",
+			version: 1,
+			src:     v4src,
+			dst:     v4dst,
+			want:    "PROXY TCP4 100.101.102.103 127.0.0.1 51234 3000\r\n",
+		},
+		{
+			name:    "v1-mixed",
+			version: 1,
+			src:     v4src,
+			dst:     v6dst,
+			want:    "PROXY TCP6 ::ffff:100.101.102.103 ::1 51234 3000\r\n",
+		},
+		{
+			name:    "v1-unknown",
+			version: 1,
+			dst:     v4dst,
+			want:    "PROXY UNKNOWN\r\n",
+		},
+		{
+			name:    "v2-ipv4",
+			version: 2,
+			src:     v4src,
+			dst:     v4dst,
+			want: proxyProtocolV2Sig + "\x21\x11\x00\x0c" +
+				"\x64\x65\x66\x67" + "\x7f\x00\x00\x01" +
+				"\xc8\x22" + "\x0b\xb8",
+		},
+		{
+			name:    "v2-unknown",
+			version: 2,
+			want:    proxyProtocolV2Sig + "\x20\x00\x00\x00",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(proxyProtocolHeader(tt.version, tt.src, tt.dst))
+			if got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"tailscale.com/tstime/rate"
+)
+
+// minLimiterIdle is the minimum time a user's limiter must go unused
+// before it's evicted.
+const minLimiterIdle = time.Minute
+
+// userLimiters is a set of rate limiters, one per Tailscale login name.
+// Limiters that have been idle long enough to have refilled completely
+// are evicted, since a new one would behave identically.
+type userLimiters struct {
+	limit rate.Limit
+	burst int
+	idle  time.Duration // how long until a limiter may be evicted
+
+	mu        sync.Mutex
+	m         map[string]*userLimiter // keyed by login name
+	lastSweep time.Time
+}
+
+type userLimiter struct {
+	lim      *rate.Limiter
+	lastUsed time.Time
+}
+
+func newUserLimiters(rps float64, burst int) *userLimiters {
+	idle := time.Duration(float64(burst) / rps * float64(time.Second))
+	if idle < minLimiterIdle {
+		idle = minLimiterIdle
+	}
+	return &userLimiters{
+		limit: rate.Limit(rps),
+		burst: burst,
+		idle:  idle,
+		m:     make(map[string]*userLimiter),
+	}
+}
+
+// allow reports whether the user with the given login name may make a
+// request now.
+func (ul *userLimiters) allow(login string, now time.Time) bool {
+	ul.mu.Lock()
+	if now.Sub(ul.lastSweep) > ul.idle {
+		ul.sweepLocked(now)
+	}
+	e, ok := ul.m[login]
+	if !ok {
+		e = &userLimiter{lim: rate.NewLimiter(ul.limit, ul.burst)}
+		ul.m[login] = e
+	}
+	e.lastUsed = now
+	ul.mu.Unlock()
+	return e.lim.Allow()
+}
+
+// sweepLocked evicts limiters that have been idle for at least ul.idle.
+// ul.mu must be held.
+func (ul *userLimiters) sweepLocked(now time.Time) {
+	for login, e := range ul.m {
+		if now.Sub(e.lastUsed) >= ul.idle {
+			delete(ul.m, login)
+		}
+	}
+	ul.lastSweep = now
+}
+
+// rateLimitHandler returns a handler that rejects requests with 429 Too
+// Many Requests when their Tailscale user exceeds its rate limit.
+// Requests whose user can't be identified aren't limited.
+func rateLimitHandler(h http.Handler, lc whoIsClient, ul *userLimiters) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		whois, err := getTailscaleUser(r.Context(), lc, r.RemoteAddr)
+		if err == nil && !ul.allow(whois.UserProfile.LoginName, time.Now()) {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,40 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUserLimiters(t *testing.T) {
+	ul := newUserLimiters(1, 2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if !ul.allow("alice@example.com", now) {
+			t.Fatalf("request %d for alice denied within burst", i)
+		}
+	}
+	if ul.allow("alice@example.com", now) {
+		t.Fatal("alice allowed beyond burst")
+	}
+	if !ul.allow("bob@example.com", now) {
+		t.Fatal("bob denied because of alice")
+	}
+	if got := len(ul.m); got != 2 {
+		t.Fatalf("have %d limiters; want 2", got)
+	}
+
+	// Once idle for long enough, both limiters are evicted on the next
+	// sweep, leaving only the user making that request.
+	now = now.Add(ul.idle + time.Second)
+	ul.allow("carol@example.com", now)
+	if _, ok := ul.m["alice@example.com"]; ok {
+		t.Error("idle limiter for alice not evicted")
+	}
+	if got := len(ul.m); got != 1 {
+		t.Errorf("have %d limiters after sweep; want 1", got)
+	}
+}
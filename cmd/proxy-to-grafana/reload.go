@@ -0,0 +1,85 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// backendTarget is the Grafana server that requests are proxied to,
+// which can be changed while running.
+type backendTarget struct {
+	url      atomic.Pointer[url.URL]
+	director atomic.Pointer[func(*http.Request)]
+}
+
+func newBackendTarget(u *url.URL) *backendTarget {
+	t := new(backendTarget)
+	t.set(u)
+	return t
+}
+
+// set makes u the backend for subsequent requests.
+func (t *backendTarget) set(u *url.URL) {
+	d := httputil.NewSingleHostReverseProxy(u).Director
+	t.director.Store(&d)
+	t.url.Store(u)
+}
+
+// direct is the httputil.ReverseProxy Director that sends r to the
+// current backend.
+func (t *backendTarget) direct(r *http.Request) {
+	(*t.director.Load())(r)
+}
+
+// backendURL returns the URL of the Grafana server at addr, which is
+// --backend-addr or the contents of --backend-addr-file.
+func backendURL(addr string) (*url.URL, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid backend address %q: %w", addr, err)
+	}
+	return url.Parse("http://" + addr)
+}
+
+// readBackendAddrFile returns the backend address in --backend-addr-file.
+func readBackendAddrFile() (string, error) {
+	b, err := os.ReadFile(*backendAddrFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// reloadBackendOnSignal re-reads --backend-addr-file on each SIGHUP and
+// switches t to the address in it, without restarting the tsnet node.
+func reloadBackendOnSignal(t *backendTarget) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+	for range sigc {
+		addr, err := readBackendAddrFile()
+		if err == nil {
+			var u *url.URL
+			if u, err = backendURL(addr); err == nil {
+				old := t.url.Load()
+				if u.Host != old.Host {
+					t.set(u)
+					log.Printf("backend changed from %s to %s", old.Host, u.Host)
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("error reloading --backend-addr-file; still proxying to %s: %v", t.url.Load().Host, err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// newRendererProxy returns a reverse proxy to the Grafana image renderer
+// at addr. It has its own transport, so that its timeouts are separate
+// from the main backend's: rendering can take a long time.
+func newRendererProxy(addr string) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: addr})
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.ResponseHeaderTimeout = *rendererTimeout
+	proxy.Transport = tr
+	if *backendTimeout503 {
+		proxy.ErrorHandler = backendErrorHandler
+	}
+	return proxy
+}
+
+// pathRouter returns a handler that sends requests for paths matching
+// paths to alt and all others to h.
+func pathRouter(h, alt http.Handler, paths pathPatterns) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if paths.match(r.URL.Path) {
+			alt.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
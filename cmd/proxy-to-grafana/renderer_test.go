@@ -0,0 +1,41 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenderer(t *testing.T) {
+	rendered := make(chan string, 1)
+	renderer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rendered <- r.URL.Path
+	}))
+	defer renderer.Close()
+
+	defer func(v string) { *rendererAddr = v }(*rendererAddr)
+	*rendererAddr = strings.TrimPrefix(renderer.URL, "http://")
+
+	proxyURL, reqs := startProxy(t, fakeWhoIs{})
+	res, err := http.Get(proxyURL + "/render/d-solo/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case path := <-rendered:
+		if path != "/render/d-solo/abc" {
+			t.Errorf("renderer got %q", path)
+		}
+	default:
+		t.Error("render request didn't reach renderer")
+	}
+	if len(reqs) != 0 {
+		t.Error("render request reached backend")
+	}
+	get(t, proxyURL, "/renderer", reqs, nil)
+}
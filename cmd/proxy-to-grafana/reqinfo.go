@@ -0,0 +1,82 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// requestIDHeader is the header carrying each request's ID, both to
+// Grafana and back to the client.
+const requestIDHeader = "X-Request-Id"
+
+// requestInfo is per-request state shared between the handlers wrapping
+// the reverse proxy and its Director and ModifyResponse hooks, which
+// can't otherwise communicate.
+type requestInfo struct {
+	id string // random ID for correlating log lines
+
+	// whois is the identified user, on /login, per getTailscaleUser.
+	// It's nil if the user wasn't identified.
+	whois *apitype.WhoIsResponse
+
+	// whoIsErr is the error identifying the user, if it failed and
+	// was logged.
+	whoIsErr error
+
+	// override, if non-nil, is the identity to use instead of WhoIs,
+	// per --allow-identity-override.
+	override *apitype.WhoIsResponse
+
+	// unidentified is whether the request came from a trusted proxy
+	// that didn't say which client it's for, so whoIs mustn't identify
+	// anyone.
+	unidentified bool
+
+	// lookup is the request's WhoIs call, once whoIs has made it.
+	lookup *whoIsLookup
+}
+
+// whoIsLookup is the result of a WhoIs call for addr.
+type whoIsLookup struct {
+	addr string
+	res  *apitype.WhoIsResponse
+	err  error
+}
+
+type requestInfoKey struct{}
+
+// getRequestInfo returns the requestInfo of the request with context
+// ctx. It's never nil; requests from outside withRequestInfo get a
+// throwaway one.
+func getRequestInfo(ctx context.Context) *requestInfo {
+	if ri, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return ri
+	}
+	return &requestInfo{}
+}
+
+// withRequestInfo returns a handler that gives each request a
+// requestInfo with a new ID, which is also sent to Grafana and the
+// client in the X-Request-Id header. Any client-supplied ID is
+// replaced.
+func withRequestInfo(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ri := &requestInfo{id: newRequestID()}
+		r.Header.Set(requestIDHeader, ri.id)
+		w.Header().Set(requestIDHeader, ri.id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, ri)))
+	})
+}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,91 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+var (
+	sanitizeMu     sync.Mutex
+	sanitizeLogged = map[string]bool{} // login names whose sanitization was logged
+)
+
+// usernameOK reports whether c may appear in the username we send
+// Grafana. It's conservative: Grafana accepts more than this, but
+// characters outside it, such as '+', spaces and non-ASCII letters,
+// have been seen to break sign-in or lookups of existing users.
+func usernameOK(c rune) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.ContainsRune("._-@", c)
+}
+
+// sanitizeUsername returns login made acceptable to Grafana as a
+// username according to mode, which is one of the --username-sanitize
+// values:
+//
+//	encode:  replace each byte of each unacceptable character with %XX
+//	reject:  return an error if there are any
+//	replace: replace each unacceptable character with '_'
+//	strip:   remove each unacceptable character
+//
+// Only encode and reject are one-to-one: '%' is itself unacceptable, so
+// it's always encoded and no two login names encode alike. With
+// replace, "a+b@example.com" and "a_b@example.com" are both
+// "a_b@example.com" to Grafana, which would sign one of them in as the
+// other. It logs the first time it changes each login name.
+func sanitizeUsername(login, mode string) (string, error) {
+	if strings.IndexFunc(login, func(c rune) bool { return !usernameOK(c) }) < 0 {
+		return login, nil
+	}
+	var name string
+	switch mode {
+	case "encode":
+		var b strings.Builder
+		for _, c := range login {
+			if usernameOK(c) {
+				b.WriteRune(c)
+				continue
+			}
+			for _, x := range []byte(string(c)) {
+				fmt.Fprintf(&b, "%%%02X", x)
+			}
+		}
+		name = b.String()
+	case "replace":
+		name = strings.Map(func(c rune) rune {
+			if usernameOK(c) {
+				return c
+			}
+			return '_'
+		}, login)
+	case "strip":
+		name = strings.Map(func(c rune) rune {
+			if usernameOK(c) {
+				return c
+			}
+			return -1
+		}, login)
+	default:
+		return "", fmt.Errorf("login name %q has characters Grafana doesn't accept in usernames", login)
+	}
+	if name == "" {
+		return "", fmt.Errorf("login name %q has no characters Grafana accepts in usernames", login)
+	}
+
+	sanitizeMu.Lock()
+	logged := sanitizeLogged[login]
+	sanitizeLogged[login] = true
+	sanitizeMu.Unlock()
+	if !logged {
+		log.Printf("signing in login name %q as Grafana user %q, per --username-sanitize=%s", login, name, mode)
+	}
+	return name, nil
+}
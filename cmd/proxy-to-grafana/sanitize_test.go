@@ -0,0 +1,98 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSanitizeUsername(t *testing.T) {
+	for _, tt := range []struct {
+		login   string
+		encode  string
+		replace string
+		strip   string
+		ok      bool // whether reject accepts it
+	}{
+		{"alice@example.com", "alice@example.com", "alice@example.com", "alice@example.com", true},
+		{"alice+grafana@example.com", "alice%2Bgrafana@example.com", "alice_grafana@example.com", "alicegrafana@example.com", false},
+		{"josé@example.com", "jos%C3%A9@example.com", "jos_@example.com", "jos@example.com", false},
+		{"bob smith@example.com", "bob%20smith@example.com", "bob_smith@example.com", "bobsmith@example.com", false},
+		{"kiosk:1", "kiosk%3A1", "kiosk_1", "kiosk1", false},
+		{"o'brien@example.com", "o%27brien@example.com", "o_brien@example.com", "obrien@example.com", false},
+		{"100%@example.com", "100%25@example.com", "100_@example.com", "100@example.com", false},
+	} {
+		if got, err := sanitizeUsername(tt.login, "encode"); err != nil || got != tt.encode {
+			t.Errorf("encode %q = %q, %v; want %q", tt.login, got, err, tt.encode)
+		}
+		if got, err := sanitizeUsername(tt.login, "replace"); err != nil || got != tt.replace {
+			t.Errorf("replace %q = %q, %v; want %q", tt.login, got, err, tt.replace)
+		}
+		if got, err := sanitizeUsername(tt.login, "strip"); err != nil || got != tt.strip {
+			t.Errorf("strip %q = %q, %v; want %q", tt.login, got, err, tt.strip)
+		}
+		if _, err := sanitizeUsername(tt.login, "reject"); (err == nil) != tt.ok {
+			t.Errorf("reject %q: err = %v; want ok = %v", tt.login, err, tt.ok)
+		}
+	}
+	if _, err := sanitizeUsername("ÅÄÖ", "strip"); err == nil {
+		t.Error("strip of all-unacceptable login name succeeded; want error")
+	}
+}
+
+func TestSanitizedIdentityHeader(t *testing.T) {
+	defer func(v string) { *sanitizeMode = v }(*sanitizeMode)
+	proxyURL, reqs := startProxy(t, localhostUser("alice+grafana@example.com", "Alice Smith"))
+
+	r := get(t, proxyURL, "/login", reqs, nil)
+	if got, want := r.Header.Get("X-Webauth-User"), "alice%2Bgrafana@example.com"; got != want {
+		t.Errorf("by default: X-Webauth-User = %q; want %q", got, want)
+	}
+
+	*sanitizeMode = "replace"
+	r = get(t, proxyURL, "/login", reqs, nil)
+	if got, want := r.Header.Get("X-Webauth-User"), "alice_grafana@example.com"; got != want {
+		t.Errorf("with --username-sanitize=replace: X-Webauth-User = %q; want %q", got, want)
+	}
+
+	*sanitizeMode = "reject"
+	res, err := http.Get(proxyURL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("with --username-sanitize=reject: got %v; want 403", res.Status)
+	}
+}
+
+func TestSanitizeCollision(t *testing.T) {
+	// Two different users whose login names differ only in a
+	// character Grafana may not accept.
+	plus := localhostUser("a+b@example.com", "A Plus")
+	underscore := localhostUser("a_b@example.com", "A Underscore")
+
+	// By default, the user with the unacceptable login name isn't
+	// signed in as the other.
+	proxyURL, reqs := startProxy(t, plus)
+	if got, want := get(t, proxyURL, "/login", reqs, nil).Header.Get("X-Webauth-User"), "a%2Bb@example.com"; got != want {
+		t.Errorf("a+b@example.com: X-Webauth-User = %q; want %q", got, want)
+	}
+	proxyURL, reqs = startProxy(t, underscore)
+	if got, want := get(t, proxyURL, "/login", reqs, nil).Header.Get("X-Webauth-User"), "a_b@example.com"; got != want {
+		t.Errorf("a_b@example.com: X-Webauth-User = %q; want %q", got, want)
+	}
+	// Nor can anyone pose as an encoded login name.
+	if a, _ := sanitizeUsername("a%2Bb@example.com", "encode"); a == "a%2Bb@example.com" {
+		t.Errorf("encode of a%%2Bb@example.com = %q; want it distinct from a+b@example.com's", a)
+	}
+
+	// That's the price of replace: they collide.
+	a, _ := sanitizeUsername("a+b@example.com", "replace")
+	b, _ := sanitizeUsername("a_b@example.com", "replace")
+	if a != b {
+		t.Errorf("replace: %q and %q; want the documented collision", a, b)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// grafanaSessionCookie is the name of Grafana's session cookie, per its
+// default login_cookie_name setting.
+const grafanaSessionCookie = "grafana_session"
+
+// sessionSweepInterval is how often sessionStarts evicts sessions
+// that have outlived their max age.
+const sessionSweepInterval = time.Minute
+
+// sessionStarts tracks when each user, by login name, was last made to
+// sign in to Grafana, for enforcing capGrafanaSession. Sessions older
+// than their max age are evicted, so it only holds users whose sessions
+// are current.
+type sessionStarts struct {
+	mu        sync.Mutex
+	m         map[string]sessionStart
+	lastSweep time.Time
+}
+
+type sessionStart struct {
+	start  time.Time
+	maxAge time.Duration
+}
+
+// expired reports whether login's session, if it's limited to maxAge,
+// is older than that at now, or isn't known to have started within it,
+// as after it's been evicted or proxy-to-grafana restarted. If so, a
+// new session is considered started.
+func (s *sessionStarts) expired(login string, maxAge time.Duration, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[string]sessionStart)
+	}
+	if now.Sub(s.lastSweep) > sessionSweepInterval {
+		for l, e := range s.m {
+			if now.Sub(e.start) > e.maxAge {
+				delete(s.m, l)
+			}
+		}
+		s.lastSweep = now
+	}
+	e, ok := s.m[login]
+	if ok && now.Sub(e.start) <= maxAge {
+		return false
+	}
+	s.m[login] = sessionStart{now, maxAge}
+	return true
+}
+
+// sessionMaxAge returns the session max age in caps' capGrafanaSession,
+// or 0 if there isn't a valid one.
+func sessionMaxAge(caps []string) time.Duration {
+	q, ok := capParams(caps, capGrafanaSession)
+	if !ok {
+		return 0
+	}
+	d, err := time.ParseDuration(q.Get("max-age"))
+	if err != nil || d <= 0 {
+		return 0
+	}
+	return d
+}
+
+// sessionAgeHandler returns a handler that makes users whose
+// capGrafanaSession says they've been signed in for too long sign in
+// again. It does so by dropping Grafana's session cookie, from the
+// request and in the browser, so Grafana sends them back through /login,
+// where modifyRequest signs them in afresh.
+func sessionAgeHandler(h http.Handler, lc whoIsClient, starts *sessionStarts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		whois, err := whoIs(r.Context(), lc, r.RemoteAddr)
+		if err == nil && whois.UserProfile != nil {
+			if maxAge := sessionMaxAge(whois.Caps); maxAge > 0 && starts.expired(whois.UserProfile.LoginName, maxAge, time.Now()) && hasCookie(r, grafanaSessionCookie) {
+				log.Printf("request %s: Grafana session of %s older than %v, or of unknown age; signing in again", getRequestInfo(r.Context()).id, whois.UserProfile.LoginName, maxAge)
+				removeCookie(r, grafanaSessionCookie)
+				http.SetCookie(w, &http.Cookie{
+					Name:     grafanaSessionCookie,
+					Value:    "",
+					Path:     "/",
+					MaxAge:   -1,
+					HttpOnly: true,
+				})
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// hasCookie reports whether r has the named cookie.
+func hasCookie(r *http.Request, name string) bool {
+	_, err := r.Cookie(name)
+	return err == nil
+}
+
+// removeCookie removes the named cookie from r's Cookie headers.
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	var kept []string
+	for _, c := range cookies {
+		if c.Name != name {
+			kept = append(kept, c.String())
+		}
+	}
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
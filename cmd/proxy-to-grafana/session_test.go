@@ -0,0 +1,75 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSessionAge(t *testing.T) {
+	lc := localhostUser("alice@example.com", "Alice Smith")
+	lc["127.0.0.1"].Caps = []string{capGrafanaSession + "?max-age=1h"}
+	starts := &sessionStarts{}
+
+	var gotCookie string
+	h := sessionAgeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotCookie = r.Header.Get("Cookie")
+	}), lc, starts)
+	do := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/d/abc", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Cookie", "grafana_session=abc; theme=dark")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// A session of unknown age is made to sign in again...
+	if rec := do(); rec.Header().Get("Set-Cookie") == "" || gotCookie != "theme=dark" {
+		t.Fatalf("unknown session: Set-Cookie %q, backend got Cookie %q", rec.Header().Get("Set-Cookie"), gotCookie)
+	}
+	// ... after which it's fresh.
+	if rec := do(); rec.Header().Get("Set-Cookie") != "" || gotCookie != "grafana_session=abc; theme=dark" {
+		t.Fatalf("fresh session: Set-Cookie %q, backend got Cookie %q", rec.Header().Get("Set-Cookie"), gotCookie)
+	}
+
+	// Age the session past its max age.
+	starts.m["alice@example.com"] = sessionStart{time.Now().Add(-2 * time.Hour), time.Hour}
+	rec := do()
+	if got, want := rec.Header().Get("Set-Cookie"), "grafana_session=; Path=/; Max-Age=0; HttpOnly"; got != want {
+		t.Errorf("expired session: Set-Cookie %q; want %q", got, want)
+	}
+	if gotCookie != "theme=dark" {
+		t.Errorf("expired session: backend got Cookie %q; want theme=dark", gotCookie)
+	}
+
+	// And the clock starts over.
+	if rec := do(); rec.Header().Get("Set-Cookie") != "" {
+		t.Errorf("new session: Set-Cookie %q; want none", rec.Header().Get("Set-Cookie"))
+	}
+}
+
+func TestSessionStartsEviction(t *testing.T) {
+	var s sessionStarts
+	now := time.Now()
+	s.expired("alice@example.com", time.Hour, now)
+	s.expired("bob@example.com", 8*time.Hour, now)
+
+	// Two hours on, Alice's session has outlived its max age, and is
+	// evicted; Bob's isn't.
+	s.expired("carol@example.com", time.Hour, now.Add(2*time.Hour))
+	if _, ok := s.m["alice@example.com"]; ok {
+		t.Error("expired session not evicted")
+	}
+	if _, ok := s.m["bob@example.com"]; !ok {
+		t.Error("current session evicted")
+	}
+	// Alice is still made to sign in again when she returns.
+	if !s.expired("alice@example.com", time.Hour, now.Add(2*time.Hour)) {
+		t.Error("evicted session not expired")
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"tailscale.com/tailcfg"
+)
+
+// sharedNodeHeader is the header that, with --shared-node-policy=tag,
+// marks requests from nodes shared into the tailnet.
+const sharedNodeHeader = "X-Tailscale-Shared-Node"
+
+// isSharedNode reports whether n was shared into this tailnet from
+// another one. WhoIs reports such nodes with a non-zero Sharer, the user
+// who shared it; its User is still the node's owner in the other
+// tailnet, who is who the request is signed in as.
+func isSharedNode(n *tailcfg.Node) bool {
+	return n != nil && !n.Sharer.IsZero()
+}
+
+// sharedNodeHandler returns a handler that applies policy, a
+// --shared-node-policy value, to requests from shared-in nodes: "deny"
+// rejects them with 403 Forbidden, and "tag" sets sharedNodeHeader on
+// them, so Grafana can treat them differently, such as by giving them a
+// different role. The header is removed from all other requests.
+func sharedNodeHandler(h http.Handler, lc whoIsClient, policy string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(sharedNodeHeader)
+		whois, err := whoIs(r.Context(), lc, r.RemoteAddr)
+		if err == nil && isSharedNode(whois.Node) {
+			if policy == "deny" {
+				log.Printf("request %s: rejecting shared-in node %s", getRequestInfo(r.Context()).id, whois.Node.Name)
+				http.Error(w, "This device is shared into the tailnet from another one, and shared devices may not use Grafana.", http.StatusForbidden)
+				return
+			}
+			r.Header.Set(sharedNodeHeader, "true")
+		}
+		h.ServeHTTP(w, r)
+	})
+}
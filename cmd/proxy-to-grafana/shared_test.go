@@ -0,0 +1,47 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestSharedNodePolicy(t *testing.T) {
+	defer func(v string) { *sharedPolicy = v }(*sharedPolicy)
+	shared := localhostUser("bob@other.example", "Bob")
+	shared["127.0.0.1"].Node = &tailcfg.Node{ID: 5, Name: "bobs-laptop.other.ts.net.", Sharer: 6}
+	spoofed := http.Header{sharedNodeHeader: {"true"}}
+
+	*sharedPolicy = "tag"
+	proxyURL, reqs := startProxy(t, shared)
+	r := get(t, proxyURL, "/login", reqs, nil)
+	if got := r.Header.Get(sharedNodeHeader); got != "true" {
+		t.Errorf("tag: %s = %q; want true", sharedNodeHeader, got)
+	}
+	if got := r.Header.Get("X-Webauth-User"); got != "bob@other.example" {
+		t.Errorf("tag: X-Webauth-User = %q; want bob@other.example", got)
+	}
+	proxyURL, reqs = startProxy(t, localhostUser("alice@example.com", "Alice Smith"))
+	r = get(t, proxyURL, "/login", reqs, spoofed)
+	if got := r.Header.Get(sharedNodeHeader); got != "" {
+		t.Errorf("tag: %s for unshared node = %q; want empty", sharedNodeHeader, got)
+	}
+
+	*sharedPolicy = "deny"
+	proxyURL, reqs = startProxy(t, shared)
+	res, err := http.Get(proxyURL + "/d/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("deny: got %v; want 403", res.Status)
+	}
+	if len(reqs) != 0 {
+		t.Error("deny: request from shared node reached backend")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/tsnet"
+)
+
+// shutdownTimeout bounds how long in-flight requests have to finish
+// once we're asked to stop.
+const shutdownTimeout = 10 * time.Second
+
+// logWriter, if non-nil, is where the log package's output goes instead
+// of stderr, such as syslog. It's closed at the very end of shutdown, so
+// nothing logged before then is lost.
+var logWriter io.WriteCloser
+
+// shutdownOnSignal waits for SIGINT or SIGTERM, then drains srvs and
+// stops ts, first logging the node out of the tailnet if
+// --logout-on-shutdown is set, and finally closes logWriter. It closes
+// done when finished.
+//
+// srvs must be all the servers with listeners on ts, so none of them
+// sees its listener closed by ts.Close and exits the process first.
+func shutdownOnSignal(srvs []*http.Server, ts *tsnet.Server, localClient *tailscale.LocalClient, done chan<- struct{}) {
+	defer close(done)
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigc
+	log.Printf("received %v; shutting down", sig)
+
+	shutdown(srvs, func(ctx context.Context) {
+		if *logoutOnShutdown {
+			if err := localClient.Logout(ctx); err != nil {
+				log.Printf("error logging out of tailnet: %v", err)
+			}
+		}
+		if err := ts.Close(); err != nil {
+			log.Printf("error closing tsnet.Server: %v", err)
+		}
+	})
+}
+
+// shutdown drains srvs, then calls stop to stop Tailscale, and finally
+// closes logWriter, so everything logged along the way is kept. All of
+// it shares one shutdownTimeout.
+func shutdown(srvs []*http.Server, stop func(context.Context)) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range srvs {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("error draining HTTP requests: %v", err)
+		}
+	}
+	stop(ctx)
+	closeLog()
+}
+
+// closeLog closes logWriter, if set, sending any later log output to
+// stderr.
+func closeLog() {
+	if logWriter == nil {
+		return
+	}
+	log.Printf("shutdown complete")
+	w := logWriter
+	logWriter = nil
+	log.SetOutput(os.Stderr)
+	log.SetFlags(log.LstdFlags)
+	if err := w.Close(); err != nil {
+		log.Printf("error closing log: %v", err)
+	}
+}
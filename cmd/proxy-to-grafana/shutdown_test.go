@@ -0,0 +1,72 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// eventLog is a logWriter that records its writes and being closed in
+// events.
+type eventLog struct {
+	events *[]string
+}
+
+func (l eventLog) Write(b []byte) (int, error) {
+	*l.events = append(*l.events, "log: "+strings.TrimSpace(string(b)))
+	return len(b), nil
+}
+
+func (l eventLog) Close() error {
+	*l.events = append(*l.events, "log closed")
+	return nil
+}
+
+func TestShutdownOrder(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	defer log.SetFlags(log.Flags())
+	var events []string
+	logWriter = eventLog{&events}
+	log.SetOutput(logWriter)
+	log.SetFlags(0)
+
+	var lns []net.Listener
+	var srvs []*http.Server
+	errc := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &http.Server{Handler: http.NotFoundHandler()}
+		go func() { errc <- srv.Serve(ln) }()
+		lns = append(lns, ln)
+		srvs = append(srvs, srv)
+	}
+
+	shutdown(srvs, func(context.Context) {
+		// As ts.Close does, close the servers' listeners.
+		for _, ln := range lns {
+			ln.Close()
+		}
+		log.Printf("stopped")
+	})
+	for range srvs {
+		if err := <-errc; err != http.ErrServerClosed {
+			t.Errorf("Serve = %v; want http.ErrServerClosed", err)
+		}
+	}
+	want := []string{"log: stopped", "log: shutdown complete", "log closed"}
+	if strings.Join(events, "\n") != strings.Join(want, "\n") {
+		t.Errorf("events:\n%s\nwant:\n%s", strings.Join(events, "\n"), strings.Join(want, "\n"))
+	}
+	if logWriter != nil {
+		t.Error("logWriter still set after shutdown")
+	}
+}
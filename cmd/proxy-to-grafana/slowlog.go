@@ -0,0 +1,33 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// slowRequestHandler returns a handler that logs a warning for each
+// request that takes h longer than threshold to serve.
+func slowRequestHandler(h http.Handler, lc whoIsClient, threshold time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h.ServeHTTP(w, r)
+		d := time.Since(start)
+		if d <= threshold {
+			return
+		}
+		// Only look up the user now, so fast requests don't pay for it,
+		// if no other handler has. The request's context may be done,
+		// but the WhoIs isn't.
+		ctx := context.WithValue(context.Background(), requestInfoKey{}, getRequestInfo(r.Context()))
+		login := "unknown user"
+		if whois, err := getTailscaleUser(ctx, lc, r.RemoteAddr); err == nil {
+			login = whois.UserProfile.LoginName
+		}
+		log.Printf("request %s: slow request: %s %s from %s took %v", getRequestInfo(r.Context()).id, r.Method, r.URL.Path, login, d.Round(time.Millisecond))
+	})
+}
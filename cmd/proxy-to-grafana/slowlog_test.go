@@ -0,0 +1,41 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowRequestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	lc := localhostUser("alice@example.com", "Alice Smith")
+	h := slowRequestHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}), lc, 10*time.Millisecond)
+
+	for _, path := range []string{"/fast", "/slow"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	got := buf.String()
+	if !strings.Contains(got, "slow request: GET /slow from alice@example.com") {
+		t.Errorf("slow request not logged; log is %q", got)
+	}
+	if strings.Contains(got, "/fast") {
+		t.Errorf("fast request logged; log is %q", got)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// backendStatePollInterval is how often watchBackendState checks the
+// tailscale backend's state.
+const backendStatePollInterval = 30 * time.Second
+
+// statusClient is the part of *tailscale.LocalClient used to watch the
+// backend's state. It's an interface so tests can fake it.
+type statusClient interface {
+	StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error)
+}
+
+// backendState is the tailscale backend's last known state, such as
+// "Running", or a description of why it couldn't be determined.
+var backendState atomic.Pointer[string]
+
+// watchBackendState checks the tailscale backend's state every
+// backendStatePollInterval, forever, logging changes and reflecting
+// them in /debug/ready and the metrics.
+func watchBackendState(lc statusClient) {
+	for {
+		checkBackendState(lc)
+		time.Sleep(backendStatePollInterval)
+	}
+}
+
+// checkBackendState updates backendState from lc, logging any change,
+// and lastControlContact.
+func checkBackendState(lc statusClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var state string
+	st, err := lc.StatusWithoutPeers(ctx)
+	if err != nil {
+		state = fmt.Sprintf("unknown (%v)", err)
+	} else {
+		state = st.BackendState
+		if inContactWithControl(st) {
+			lastControlContact.Store(time.Now().UnixNano())
+		}
+	}
+	old := backendState.Swap(&state)
+	if state == "Running" {
+		tailscaleRunning.Set(1)
+	} else {
+		tailscaleRunning.Set(0)
+	}
+	switch {
+	case old == nil || *old == state:
+	case state == "Running":
+		log.Printf("tailscale backend is Running again (was %s)", *old)
+		backendStateChanges.Add(1)
+	case *old == "Running":
+		log.Printf("WARNING: tailscale backend is %s (was Running); users can't reach Grafana until it recovers", state)
+		backendStateChanges.Add(1)
+	default:
+		log.Printf("tailscale backend is %s (was %s)", state, *old)
+	}
+}
+
+// readyHandler serves /debug/ready: 200 OK while the tailscale backend
+// is Running, for readiness probes, and 503 Service Unavailable
+// otherwise.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	state := "unknown"
+	if s := backendState.Load(); s != nil {
+		state = *s
+	}
+	if state != "Running" {
+		http.Error(w, "not ready: tailscale backend is "+state, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
@@ -0,0 +1,55 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// fakeStatus is a statusClient reporting a fixed backend state, or
+// failing if it's empty.
+type fakeStatus string
+
+func (f fakeStatus) StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error) {
+	if f == "" {
+		return nil, errors.New("localapi unreachable")
+	}
+	return &ipnstate.Status{BackendState: string(f)}, nil
+}
+
+func TestBackendState(t *testing.T) {
+	defer backendState.Store(backendState.Load())
+	changes := backendStateChanges.Value()
+
+	for _, tt := range []struct {
+		state   fakeStatus
+		running int64
+		code    int
+	}{
+		{"Running", 1, http.StatusOK},
+		{"Starting", 0, http.StatusServiceUnavailable},
+		{"", 0, http.StatusServiceUnavailable},
+		{"Running", 1, http.StatusOK},
+	} {
+		checkBackendState(tt.state)
+		if got := tailscaleRunning.Value(); got != tt.running {
+			t.Errorf("%q: gauge_tailscale_running = %d; want %d", tt.state, got, tt.running)
+		}
+		rec := httptest.NewRecorder()
+		readyHandler(rec, httptest.NewRequest("GET", "/debug/ready", nil))
+		if rec.Code != tt.code {
+			t.Errorf("%q: /debug/ready = %d; want %d", tt.state, rec.Code, tt.code)
+		}
+	}
+	// Only entering and leaving Running count.
+	if got := backendStateChanges.Value() - changes; got != 2 {
+		t.Errorf("counter_backend_state_changes went up by %d; want 2", got)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Only responses for paths under staticPrefix are cached. That's where
+// Grafana serves its JS, CSS, fonts and images, none of which depend on
+// who's asking.
+const staticPrefix = "/public/"
+
+// minCacheMaxAge is the smallest Cache-Control max-age for which a
+// response is worth caching; shorter-lived ones are left to the browser.
+const minCacheMaxAge = time.Hour
+
+// staticCache is an in-memory LRU cache of Grafana's static assets, for
+// users for whom fetching them from Grafana over the tailnet is slow.
+type staticCache struct {
+	maxBytes int64 // bound on the total size of cached bodies
+
+	mu   sync.Mutex
+	size int64                      // total size of cached bodies
+	ll   *list.List                 // of *cacheEntry, most recently used first
+	m    map[cacheKey]*list.Element // elements of ll
+}
+
+// cacheKey identifies a cached response. The Accept-Encoding is part of
+// it because Grafana compresses responses when asked.
+type cacheKey struct {
+	uri            string // the request URI: path and query
+	acceptEncoding string
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func newStaticCache(maxBytes int64) *staticCache {
+	return &staticCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		m:        make(map[cacheKey]*list.Element),
+	}
+}
+
+// get returns the fresh entry for k, if any.
+func (c *staticCache) get(k cacheKey, now time.Time) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.m[k]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if now.After(e.expires) {
+		c.removeLocked(el)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return e, true
+}
+
+// add adds e to the cache, evicting the least recently used entries as
+// needed to stay within c.maxBytes.
+func (c *staticCache) add(e *cacheEntry) {
+	n := int64(len(e.body))
+	if n > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.m[e.key]; ok {
+		c.removeLocked(el)
+	}
+	for c.size+n > c.maxBytes {
+		c.removeLocked(c.ll.Back())
+	}
+	c.m[e.key] = c.ll.PushFront(e)
+	c.size += n
+}
+
+func (c *staticCache) removeLocked(el *list.Element) {
+	e := c.ll.Remove(el).(*cacheEntry)
+	delete(c.m, e.key)
+	c.size -= int64(len(e.body))
+}
+
+// staticCacheHandler returns a handler that serves Grafana's static
+// assets from c when it can, and otherwise passes requests to h,
+// caching its cacheable responses.
+func staticCacheHandler(h http.Handler, c *staticCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || !strings.HasPrefix(r.URL.Path, staticPrefix) || r.Header.Get("Range") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		k := cacheKey{r.URL.RequestURI(), r.Header.Get("Accept-Encoding")}
+		now := time.Now()
+		if e, ok := c.get(k, now); ok {
+			serveCached(w, r, e, now)
+			return
+		}
+
+		rec := &cacheRecorder{ResponseWriter: w, limit: c.maxBytes}
+		h.ServeHTTP(rec, r)
+		if rec.overflow {
+			return
+		}
+		maxAge, ok := cacheableFor(rec.status, w.Header())
+		if !ok {
+			return
+		}
+		header := w.Header().Clone()
+		header.Del(requestIDHeader)
+		c.add(&cacheEntry{
+			key:     k,
+			header:  header,
+			body:    rec.buf.Bytes(),
+			stored:  now,
+			expires: now.Add(maxAge),
+		})
+	})
+}
+
+// serveCached replies to r with the cached response e, or 304 Not
+// Modified if r already has it.
+func serveCached(w http.ResponseWriter, r *http.Request, e *cacheEntry, now time.Time) {
+	for k, vv := range e.header {
+		w.Header()[k] = vv
+	}
+	w.Header().Set("Age", strconv.Itoa(int(now.Sub(e.stored).Seconds())))
+	if etag := e.header.Get("Etag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(e.body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(e.body)
+}
+
+// cacheableFor reports whether a response with the given status and
+// header may be cached, and for how long.
+func cacheableFor(status int, h http.Header) (time.Duration, bool) {
+	if status != http.StatusOK || h.Get("Set-Cookie") != "" {
+		return 0, false
+	}
+	if v := h.Get("Vary"); v != "" && !strings.EqualFold(v, "Accept-Encoding") {
+		return 0, false
+	}
+	var maxAge time.Duration
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		switch {
+		case d == "no-store" || d == "no-cache" || d == "private":
+			return 0, false
+		case strings.HasPrefix(d, "max-age="):
+			secs, err := strconv.Atoi(strings.TrimPrefix(d, "max-age="))
+			if err != nil {
+				return 0, false
+			}
+			maxAge = time.Duration(secs) * time.Second
+		}
+	}
+	return maxAge, maxAge >= minCacheMaxAge
+}
+
+// cacheRecorder is an http.ResponseWriter that records the response
+// written through it, up to limit bytes of body.
+type cacheRecorder struct {
+	http.ResponseWriter
+	limit int64
+
+	status   int
+	buf      bytes.Buffer
+	overflow bool // body exceeded limit; buf is empty
+}
+
+func (r *cacheRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *cacheRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if !r.overflow {
+		if int64(r.buf.Len()+len(b)) > r.limit {
+			r.overflow = true
+			r.buf = bytes.Buffer{}
+		} else {
+			r.buf.Write(b)
+		}
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying ResponseWriter, for
+// http.ResponseController.
+func (r *cacheRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
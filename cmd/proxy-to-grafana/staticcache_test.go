@@ -0,0 +1,88 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStaticCache(t *testing.T) {
+	hits := map[string]int{}
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.URL.Path]++
+		switch r.URL.Path {
+		case "/public/build/app.js", "/public/build/big.js":
+			w.Header().Set("Cache-Control", "public, max-age=31536000")
+			w.Header().Set("Etag", `"v1"`)
+		case "/public/build/short.js":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/api/user":
+			w.Header().Set("Cache-Control", "max-age=31536000")
+		}
+		if r.URL.Path == "/public/build/big.js" {
+			w.Write([]byte(strings.Repeat("x", 100)))
+			return
+		}
+		w.Write([]byte("body of " + r.URL.Path))
+	})
+	h := staticCacheHandler(backend, newStaticCache(64))
+
+	do := func(path string, hdr http.Header) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", path, nil)
+		for k, vv := range hdr {
+			req.Header[k] = vv
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 3; i++ {
+		for _, path := range []string{"/public/build/app.js", "/public/build/short.js", "/public/build/big.js", "/api/user"} {
+			if rec := do(path, nil); rec.Code != http.StatusOK {
+				t.Fatalf("GET %s: status %d", path, rec.Code)
+			}
+		}
+	}
+	for path, want := range map[string]int{
+		"/public/build/app.js":   1,
+		"/public/build/short.js": 3, // max-age too short
+		"/public/build/big.js":   3, // bigger than the cache
+		"/api/user":              3, // not a static asset
+	} {
+		if got := hits[path]; got != want {
+			t.Errorf("backend got %d requests for %s; want %d", got, path, want)
+		}
+	}
+
+	rec := do("/public/build/app.js", nil)
+	if got, want := rec.Body.String(), "body of /public/build/app.js"; got != want {
+		t.Errorf("cached body = %q; want %q", got, want)
+	}
+	rec = do("/public/build/app.js", http.Header{"If-None-Match": {`"v1"`}})
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("matching If-None-Match: status %d; want 304", rec.Code)
+	}
+	rec = do("/public/build/app.js", http.Header{"If-None-Match": {`"v0"`}})
+	if rec.Code != http.StatusOK {
+		t.Errorf("stale If-None-Match: status %d; want 200", rec.Code)
+	}
+}
+
+func TestStaticCacheEviction(t *testing.T) {
+	c := newStaticCache(10)
+	for _, uri := range []string{"/a", "/b", "/c"} {
+		c.add(&cacheEntry{key: cacheKey{uri: uri}, body: []byte("1234")})
+	}
+	if _, ok := c.m[cacheKey{uri: "/a"}]; ok {
+		t.Error("least recently used entry not evicted")
+	}
+	if c.size != 8 || len(c.m) != 2 {
+		t.Errorf("size %d with %d entries; want 8 with 2", c.size, len(c.m))
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log"
+	"log/syslog"
+	"strings"
+)
+
+// useSyslog sends the log package's output to syslog: the local one, or
+// the remote one at --syslog-addr. If syslog can't be reached, logs stay
+// on stderr.
+func useSyslog() {
+	network, raddr := "", *syslogAddr
+	if n, a, ok := strings.Cut(raddr, "://"); ok {
+		network, raddr = n, a
+	} else if raddr != "" {
+		network = "udp"
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, "proxy-to-grafana")
+	if err != nil {
+		log.Printf("warning: can't connect to syslog, logging to stderr instead: %v", err)
+		return
+	}
+	// syslog records its own timestamps.
+	log.SetFlags(0)
+	log.SetOutput(w)
+	logWriter = w
+}
@@ -0,0 +1,12 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build windows || plan9
+
+package main
+
+import "log"
+
+func useSyslog() {
+	log.Printf("warning: syslog isn't supported on this platform, logging to stderr instead")
+}
@@ -0,0 +1,31 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// mapTagged reports whether tagged nodes are signed in as users named
+// per --tagged-user-pattern, per --allow-tagged or
+// --tagged-node-policy=map.
+func mapTagged() bool {
+	return *allowTagged || *taggedPolicy == "map"
+}
+
+// denyTaggedHandler returns a handler that rejects requests from tagged
+// nodes with 403 Forbidden, for --tagged-node-policy=deny, rather than
+// forwarding them without an identity.
+func denyTaggedHandler(h http.Handler, lc whoIsClient) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		whois, err := whoIs(r.Context(), lc, r.RemoteAddr)
+		if err == nil && whois.Node.IsTagged() {
+			log.Printf("request %s: rejecting tagged node %s", getRequestInfo(r.Context()).id, whois.Node.Name)
+			http.Error(w, "This device is tagged, so it has no Tailscale user to sign in to Grafana as. Please use Grafana from a device that belongs to you.", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
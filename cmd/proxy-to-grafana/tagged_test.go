@@ -0,0 +1,66 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestTaggedNodePolicy(t *testing.T) {
+	defer func(v, p string) { *taggedPolicy, *taggedUserPattern = v, p }(*taggedPolicy, *taggedUserPattern)
+	lc := fakeWhoIs{
+		"127.0.0.1": {
+			Node:        &tailcfg.Node{ID: 1, ComputedName: "kiosk", Tags: []string{"tag:kiosk"}},
+			UserProfile: &tailcfg.UserProfile{ID: 3, LoginName: "tagged-devices", DisplayName: "Tagged Devices"},
+		},
+	}
+
+	*taggedPolicy = "deny"
+	proxyURL, reqs := startProxy(t, lc)
+	for _, path := range []string{"/login", "/d/abc"} {
+		res, err := http.Get(proxyURL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("deny: %s got %v; want 403", path, res.Status)
+		}
+	}
+	if len(reqs) != 0 {
+		t.Error("deny: request from tagged node reached backend")
+	}
+
+	*taggedPolicy = "map"
+	*taggedUserPattern = "kiosks@example.com"
+	proxyURL, reqs = startProxy(t, lc)
+	r := get(t, proxyURL, "/login", reqs, nil)
+	if got, want := r.Header.Get("X-Webauth-User"), "kiosks@example.com"; got != want {
+		t.Errorf("map: X-Webauth-User = %q; want %q", got, want)
+	}
+}
+
+func TestTaggedUserDefaultPattern(t *testing.T) {
+	defer func(v string) { *taggedPolicy = v }(*taggedPolicy)
+	*taggedPolicy = "map"
+
+	// A node named like one of Grafana's own accounts doesn't get it.
+	lc := fakeWhoIs{"127.0.0.1": {Node: &tailcfg.Node{ID: 1, ComputedName: "admin", Tags: []string{"tag:kiosk"}}}}
+	proxyURL, reqs := startProxy(t, lc)
+	r := get(t, proxyURL, "/login", reqs, nil)
+	if got, want := r.Header.Get("X-Webauth-User"), "admin@tagged.invalid"; got != want {
+		t.Errorf("X-Webauth-User = %q; want %q", got, want)
+	}
+
+	// A node with no name isn't signed in at all.
+	lc = fakeWhoIs{"127.0.0.1": {Node: &tailcfg.Node{ID: 2, Tags: []string{"tag:kiosk"}}}}
+	proxyURL, reqs = startProxy(t, lc)
+	r = get(t, proxyURL, "/login", reqs, nil)
+	if got := r.Header.Get("X-Webauth-User"); got != "" {
+		t.Errorf("X-Webauth-User for nameless node = %q; want empty", got)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"tailscale.com/tailcfg"
+)
+
+// tailnetHeaderHandler returns a handler that sets the named header on
+// each request to the tailnet domain of the node it came from, such as
+// "example.ts.net", or removes it if that can't be determined.
+func tailnetHeaderHandler(h http.Handler, lc whoIsClient, header string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(header)
+		whois, err := whoIs(r.Context(), lc, r.RemoteAddr)
+		if err == nil {
+			if tn := tailnetOf(whois.Node); tn != "" {
+				r.Header.Set(header, tn)
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// nodeIDHeaderHandler returns a handler that sets the named header on
+// each request to the stable node ID of the node it came from, which,
+// unlike its name, never changes, or removes it if that's unknown.
+func nodeIDHeaderHandler(h http.Handler, lc whoIsClient, header string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(header)
+		whois, err := whoIs(r.Context(), lc, r.RemoteAddr)
+		if err == nil && whois.Node != nil && !whois.Node.StableID.IsZero() {
+			r.Header.Set(header, string(whois.Node.StableID))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// tailnetOf returns the tailnet domain of n, taken from its MagicDNS
+// name: "laptop.example.ts.net." is in "example.ts.net". It returns the
+// empty string if n doesn't have such a name.
+func tailnetOf(n *tailcfg.Node) string {
+	if n == nil {
+		return ""
+	}
+	_, domain, ok := strings.Cut(strings.TrimSuffix(n.Name, "."), ".")
+	if !ok || !strings.Contains(domain, ".") {
+		return ""
+	}
+	return domain
+}
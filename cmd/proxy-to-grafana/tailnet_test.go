@@ -0,0 +1,43 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTailnetHeader(t *testing.T) {
+	defer func(v string) { *tailnetHeader = v }(*tailnetHeader)
+	*tailnetHeader = "X-Tailnet"
+
+	proxyURL, reqs := startProxy(t, localhostUser("alice@example.com", "Alice Smith"))
+	r := get(t, proxyURL, "/d/abc", reqs, http.Header{"X-Tailnet": {"spoofed.ts.net"}})
+	if got, want := r.Header.Get("X-Tailnet"), "example.ts.net"; got != want {
+		t.Errorf("X-Tailnet = %q; want %q", got, want)
+	}
+
+	proxyURL, reqs = startProxy(t, fakeWhoIs{})
+	r = get(t, proxyURL, "/d/abc", reqs, http.Header{"X-Tailnet": {"spoofed.ts.net"}})
+	if got := r.Header.Get("X-Tailnet"); got != "" {
+		t.Errorf("X-Tailnet for unknown node = %q; want empty", got)
+	}
+}
+
+func TestNodeIDHeader(t *testing.T) {
+	defer func(v string) { *nodeIDHeader = v }(*nodeIDHeader)
+	*nodeIDHeader = "X-Tailscale-Node-ID"
+
+	proxyURL, reqs := startProxy(t, localhostUser("alice@example.com", "Alice Smith"))
+	r := get(t, proxyURL, "/d/abc", reqs, http.Header{"X-Tailscale-Node-ID": {"spoofed"}})
+	if got, want := r.Header.Get("X-Tailscale-Node-ID"), "nLaptop1CNTRL"; got != want {
+		t.Errorf("X-Tailscale-Node-ID = %q; want %q", got, want)
+	}
+
+	proxyURL, reqs = startProxy(t, fakeWhoIs{})
+	r = get(t, proxyURL, "/d/abc", reqs, http.Header{"X-Tailscale-Node-ID": {"spoofed"}})
+	if got := r.Header.Get("X-Tailscale-Node-ID"); got != "" {
+		t.Errorf("X-Tailscale-Node-ID for unknown node = %q; want empty", got)
+	}
+}
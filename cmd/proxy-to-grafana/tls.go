@@ -0,0 +1,181 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/exp/slices"
+	"tailscale.com/client/tailscale"
+)
+
+// getCertFunc is the type of tls.Config.GetCertificate.
+type getCertFunc func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+// logSNI returns a getCertFunc that logs the SNI name of each TLS
+// handshake, and whether getting a cert for it failed.
+func logSNI(getCert getCertFunc) getCertFunc {
+	return func(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := getCert(hi)
+		if err != nil {
+			log.Printf("TLS handshake from %v for SNI %q: getting cert: %v", hi.Conn.RemoteAddr(), hi.ServerName, err)
+		} else {
+			log.Printf("TLS handshake from %v for SNI %q", hi.Conn.RemoteAddr(), hi.ServerName)
+		}
+		return cert, err
+	}
+}
+
+// certFailures returns a getCertFunc that logs each failure of getCert,
+// which otherwise only shows up as a failed TLS handshake. If threshold
+// is non-zero, it calls fatalf once getting the cert for certName fails
+// that many times in a row. Failures for other SNI names, such as
+// handshakes without SNI or for made-up names, which anyone who can
+// reach us can cause, don't count.
+func certFailures(getCert getCertFunc, certName string, threshold int, fatalf func(format string, args ...any)) getCertFunc {
+	var failures atomic.Int64 // consecutive, for certName
+	return func(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := getCert(hi)
+		ours := strings.EqualFold(hi.ServerName, certName)
+		if err == nil {
+			if ours {
+				failures.Store(0)
+			}
+			return cert, nil
+		}
+		if !ours {
+			log.Printf("error getting TLS cert for %q: %v", hi.ServerName, err)
+			return nil, err
+		}
+		n := failures.Add(1)
+		log.Printf("error getting TLS cert for %q (%d consecutive failures): %v", hi.ServerName, n, err)
+		if threshold > 0 && n >= int64(threshold) {
+			fatalf("giving up after %d consecutive failures to get the TLS cert; HTTPS is broken: %v", n, err)
+		}
+		return nil, err
+	}
+}
+
+// allowSNI returns a getCertFunc that fails handshakes whose SNI name
+// isn't one of hosts, rather than asking getCert for a cert for it.
+func allowSNI(getCert getCertFunc, hosts []string) getCertFunc {
+	return func(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if !slices.Contains(hosts, strings.ToLower(hi.ServerName)) {
+			return nil, fmt.Errorf("SNI name %q not in --allowed-hosts", hi.ServerName)
+		}
+		return getCert(hi)
+	}
+}
+
+// parseHostList parses a comma-separated list of host names.
+func parseHostList(s string) []string {
+	var hosts []string
+	for _, h := range strings.Split(s, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// newTLSConfig returns the TLS config for serving HTTPS as certName with
+// certs from localClient, configured per flags.
+func newTLSConfig(localClient *tailscale.LocalClient, certName string) (*tls.Config, error) {
+	getCert := certFailures(localClient.GetCertificate, certName, *certFailExit, log.Fatalf)
+	if *allowedHosts != "" {
+		getCert = allowSNI(getCert, parseHostList(*allowedHosts))
+	}
+	if *logTLSSNI {
+		getCert = logSNI(getCert)
+	}
+	conf := &tls.Config{
+		GetCertificate: getCert,
+
+		// Go enables session tickets by default, rotating their keys
+		// itself; this just makes them explicit and switchable.
+		SessionTicketsDisabled: !*sessionTickets,
+	}
+	if *grpcBackendAddr != "" {
+		conf.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if *clientCertHeader != "" {
+		pem, err := os.ReadFile(*clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certs in %q", *clientCAFile)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return conf, nil
+}
+
+// clientCertHandler returns a handler that sets the header named header
+// to the subject of the request's verified TLS client certificate, if
+// any. Requests' own values for header are always removed.
+func clientCertHandler(h http.Handler, header string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(header)
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			r.Header.Set(header, r.TLS.VerifiedChains[0][0].Subject.String())
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// tlsInfo describes the TLS version and ALPN protocol negotiated for cs,
+// like "TLS 1.3; alpn=h2".
+func tlsInfo(cs *tls.ConnectionState) string {
+	info := tls.VersionName(cs.Version)
+	if cs.NegotiatedProtocol != "" {
+		info += "; alpn=" + cs.NegotiatedProtocol
+	}
+	return info
+}
+
+// tlsInfoHandler returns a handler that sets the header named header to
+// the tlsInfo of each request's TLS connection. Requests' own values for
+// header are always removed.
+func tlsInfoHandler(h http.Handler, header string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(header)
+		if r.TLS != nil {
+			r.Header.Set(header, tlsInfo(r.TLS))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// tlsInfoLogger returns an http.Server ConnState hook that logs the
+// tlsInfo of each TLS connection once its handshake is done.
+func tlsInfoLogger() func(net.Conn, http.ConnState) {
+	var logged sync.Map // net.Conn => true
+	return func(c net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateActive:
+			tc, ok := c.(*tls.Conn)
+			if !ok {
+				return
+			}
+			if _, dup := logged.LoadOrStore(c, true); !dup {
+				cs := tc.ConnectionState()
+				log.Printf("TLS connection from %v negotiated %s", c.RemoteAddr(), tlsInfo(&cs))
+			}
+		case http.StateClosed, http.StateHijacked:
+			logged.Delete(c)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowSNI(t *testing.T) {
+	var asked []string
+	getCert := allowSNI(func(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		asked = append(asked, hi.ServerName)
+		return &tls.Certificate{}, nil
+	}, parseHostList("grafana.example.ts.net, Grafana.Example.COM"))
+
+	for _, tt := range []struct {
+		sni  string
+		okay bool
+	}{
+		{"grafana.example.ts.net", true},
+		{"GRAFANA.example.ts.net", true},
+		{"grafana.example.com", true},
+		{"other.example.ts.net", false},
+		{"", false},
+	} {
+		_, err := getCert(&tls.ClientHelloInfo{ServerName: tt.sni})
+		if (err == nil) != tt.okay {
+			t.Errorf("SNI %q: err = %v; want ok = %v", tt.sni, err, tt.okay)
+		}
+	}
+	if len(asked) != 3 {
+		t.Errorf("certs fetched for %q; want only the allowed names", asked)
+	}
+}
+
+func TestSessionTickets(t *testing.T) {
+	defer func(v bool) { *sessionTickets = v }(*sessionTickets)
+	for _, enabled := range []bool{true, false} {
+		*sessionTickets = enabled
+		conf, err := newTLSConfig(nil, "grafana.example.ts.net")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conf.SessionTicketsDisabled == enabled {
+			t.Errorf("--tls-session-tickets=%v: SessionTicketsDisabled = %v", enabled, conf.SessionTicketsDisabled)
+		}
+	}
+}
+
+func TestCertFailures(t *testing.T) {
+	fail := true
+	var fatal bool
+	getCert := certFailures(func(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if fail {
+			return nil, errors.New("cert unavailable")
+		}
+		return &tls.Certificate{}, nil
+	}, "grafana.example.ts.net", 3, func(string, ...any) { fatal = true })
+
+	hi := &tls.ClientHelloInfo{ServerName: "grafana.example.ts.net"}
+	for i := 0; i < 2; i++ {
+		getCert(hi)
+	}
+	// A success resets the count.
+	fail = false
+	if _, err := getCert(hi); err != nil {
+		t.Fatal(err)
+	}
+	fail = true
+	for i := 0; i < 2; i++ {
+		getCert(hi)
+	}
+	if fatal {
+		t.Fatal("gave up before 3 consecutive failures")
+	}
+	// Handshakes without SNI, or for names that aren't ours, fail too,
+	// but don't count.
+	for _, name := range []string{"", "100.64.0.1", "bogus.example.com"} {
+		for i := 0; i < 5; i++ {
+			getCert(&tls.ClientHelloInfo{ServerName: name})
+		}
+	}
+	if fatal {
+		t.Fatal("gave up after failures for other SNI names")
+	}
+	getCert(&tls.ClientHelloInfo{ServerName: "Grafana.Example.ts.net"})
+	if !fatal {
+		t.Error("didn't give up after 3 consecutive failures")
+	}
+}
+
+func TestTLSInfoHeader(t *testing.T) {
+	var got string
+	h := tlsInfoHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-TLS-Info")
+	}), "X-TLS-Info")
+
+	req := httptest.NewRequest("GET", "/d/abc", nil)
+	req.Header.Set("X-TLS-Info", "spoofed")
+	req.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, NegotiatedProtocol: "h2"}
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if want := "TLS 1.3; alpn=h2"; got != want {
+		t.Errorf("X-TLS-Info = %q; want %q", got, want)
+	}
+
+	req = httptest.NewRequest("GET", "/d/abc", nil)
+	req.Header.Set("X-TLS-Info", "spoofed")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "" {
+		t.Errorf("X-TLS-Info without TLS = %q; want empty", got)
+	}
+}
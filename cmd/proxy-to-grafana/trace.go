@@ -0,0 +1,65 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// propagateTraceContext updates the W3C Trace Context headers
+// (https://www.w3.org/TR/trace-context/) of a request to Grafana so the
+// proxy appears as a hop in its traces: the request continues the trace
+// in its traceparent header, if valid, as a child of a new span ID for
+// the proxy, or else starts a new, sampled trace. tracestate is passed
+// on with a valid traceparent and removed otherwise, per the spec.
+func propagateTraceContext(h http.Header) {
+	traceID, flags, ok := parseTraceParent(h.Get("traceparent"))
+	if !ok {
+		h.Del("tracestate")
+		traceID, flags = randomHex(16), "01"
+	}
+	h.Set("traceparent", "00-"+traceID+"-"+randomHex(8)+"-"+flags)
+}
+
+// parseTraceParent returns the trace ID and trace flags of the
+// traceparent header value v, and whether it's valid.
+func parseTraceParent(v string) (traceID, flags string, ok bool) {
+	// version "-" trace-id "-" parent-id "-" trace-flags, and for
+	// versions after 00, possibly more fields.
+	if len(v) < 55 || (len(v) > 55 && (v[:2] == "00" || v[55] != '-')) {
+		return "", "", false
+	}
+	version, traceID, parentID, flags := v[:2], v[3:35], v[36:52], v[53:55]
+	if v[2] != '-' || v[35] != '-' || v[52] != '-' || version == "ff" {
+		return "", "", false
+	}
+	for _, f := range []string{version, traceID, parentID, flags} {
+		if !isLowerHex(f) {
+			return "", "", false
+		}
+	}
+	if strings.Trim(traceID, "0") == "" || strings.Trim(parentID, "0") == "" {
+		return "", "", false
+	}
+	return traceID, flags, true
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// randomHex returns n random bytes, hex-encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,58 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	for _, tt := range []struct {
+		in    string
+		valid bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7-01", false},
+		{"", false},
+	} {
+		if _, _, ok := parseTraceParent(tt.in); ok != tt.valid {
+			t.Errorf("parseTraceParent(%q) ok = %v; want %v", tt.in, ok, tt.valid)
+		}
+	}
+}
+
+func TestTraceContext(t *testing.T) {
+	defer func(v bool) { *traceContext = v }(*traceContext)
+	*traceContext = true
+	proxyURL, reqs := startProxy(t, fakeWhoIs{})
+
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	r := get(t, proxyURL, "/d/abc", reqs, http.Header{"Traceparent": {parent}, "Tracestate": {"vendor=1"}})
+	tp := r.Header.Get("traceparent")
+	if !strings.HasPrefix(tp, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || tp == parent {
+		t.Errorf("traceparent = %q; want same trace, new span", tp)
+	}
+	if _, _, ok := parseTraceParent(tp); !ok {
+		t.Errorf("invalid traceparent %q", tp)
+	}
+	if got := r.Header.Get("tracestate"); got != "vendor=1" {
+		t.Errorf("tracestate = %q; want vendor=1", got)
+	}
+
+	r = get(t, proxyURL, "/d/abc", reqs, http.Header{"Traceparent": {"garbage"}, "Tracestate": {"vendor=1"}})
+	if _, _, ok := parseTraceParent(r.Header.Get("traceparent")); !ok {
+		t.Errorf("new traceparent %q is invalid", r.Header.Get("traceparent"))
+	}
+	if got := r.Header.Get("tracestate"); got != "" {
+		t.Errorf("tracestate for new trace = %q; want empty", got)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// prefixList is a list of IP prefixes.
+type prefixList []netip.Prefix
+
+// parsePrefixList parses a comma-separated list of CIDR prefixes or
+// single IP addresses.
+func parsePrefixList(s string) (prefixList, error) {
+	var pl prefixList
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if ip, err := netip.ParseAddr(v); err == nil {
+			pl = append(pl, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad IP prefix %q: %w", v, err)
+		}
+		pl = append(pl, p.Masked())
+	}
+	return pl, nil
+}
+
+func (pl prefixList) contains(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range pl {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedProxiesHandler returns a handler that, for requests from one of
+// the trusted reverse proxies, replaces the request's RemoteAddr with
+// that of the client the proxies got it from, per X-Forwarded-For, so
+// that's who WhoIs identifies.
+//
+// The client is the right-most X-Forwarded-For address that isn't a
+// trusted proxy, since only the trusted proxies' additions can be
+// believed: anything to the left of them came from the client. If there
+// is no such address, because X-Forwarded-For is missing or lists only
+// trusted proxies, the request is forwarded unidentified, rather than
+// as one of the proxies. Requests from anywhere else are left alone,
+// whatever X-Forwarded-For they claim.
+func trustedProxiesHandler(h http.Handler, trusted prefixList) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil || !trusted.contains(peer.Addr()) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		var hops []string
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+		var client netip.Addr
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				// Garbage from the client (or a broken proxy);
+				// nothing to its left can be believed.
+				http.Error(w, "invalid X-Forwarded-For", http.StatusBadRequest)
+				return
+			}
+			if ip = ip.Unmap(); !trusted.contains(ip) {
+				client = ip
+				break
+			}
+		}
+		if client.IsValid() {
+			// WhoIs wants a port, but only the IP matters for
+			// identifying tailnet nodes.
+			r.RemoteAddr = netip.AddrPortFrom(client, 0).String()
+		} else {
+			getRequestInfo(r.Context()).unidentified = true
+		}
+		// Don't have the reverse proxy pass on hops it couldn't vouch
+		// for; it appends the new RemoteAddr.
+		r.Header.Del("X-Forwarded-For")
+		h.ServeHTTP(w, r)
+	})
+}
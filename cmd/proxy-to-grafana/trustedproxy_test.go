@@ -0,0 +1,68 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	trusted, err := parsePrefixList("100.100.1.2, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	var unidentified bool
+	h := withRequestInfo(trustedProxiesHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.RemoteAddr
+		unidentified = getRequestInfo(r.Context()).unidentified
+	}), trusted))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		want       string // RemoteAddr seen by h; empty means rejected
+		anonymous  bool   // whether h sees the request as unidentified
+	}{
+		{"untrusted-peer", "100.64.0.9:1234", []string{"100.64.0.1"}, "100.64.0.9:1234", false},
+		{"trusted-peer", "100.100.1.2:1234", []string{"100.64.0.1"}, "100.64.0.1:0", false},
+		{"spoofed-left", "100.100.1.2:1234", []string{"100.64.0.66, 100.64.0.1"}, "100.64.0.1:0", false},
+		{"chain", "100.100.1.2:1234", []string{"100.64.0.1, 10.1.2.3"}, "100.64.0.1:0", false},
+		{"multiple-headers", "100.100.1.2:1234", []string{"100.64.0.66", "100.64.0.1"}, "100.64.0.1:0", false},
+		{"all-trusted", "100.100.1.2:1234", []string{"10.9.9.9, 10.1.2.3"}, "100.100.1.2:1234", true},
+		{"no-xff", "100.100.1.2:1234", nil, "100.100.1.2:1234", true},
+		{"garbage", "100.100.1.2:1234", []string{"100.64.0.1, bogus"}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, unidentified = "", false
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header["X-Forwarded-For"] = tt.xff
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			if got != tt.want {
+				t.Errorf("RemoteAddr = %q; want %q", got, tt.want)
+			}
+			if unidentified != tt.anonymous {
+				t.Errorf("unidentified = %v; want %v", unidentified, tt.anonymous)
+			}
+		})
+	}
+}
+
+func TestTrustedProxyWithoutForwardedFor(t *testing.T) {
+	defer func(v string) { *trustedProxies = v }(*trustedProxies)
+	// The test client, on localhost, is the trusted proxy. Its node's
+	// identity mustn't be used for requests it doesn't attribute.
+	*trustedProxies = "127.0.0.1"
+	proxyURL, reqs := startProxy(t, localhostUser("proxy-owner@example.com", "Proxy Owner"))
+
+	r := get(t, proxyURL, "/login", reqs, nil)
+	if got := r.Header.Get("X-Webauth-User"); got != "" {
+		t.Errorf("without X-Forwarded-For: X-Webauth-User = %q; want empty", got)
+	}
+}
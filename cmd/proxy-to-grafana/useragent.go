@@ -0,0 +1,24 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"tailscale.com/version"
+)
+
+// setUserAgent sets the User-Agent of a request to Grafana per pattern,
+// a --user-agent value, in which {client} is replaced by the client's own
+// User-Agent and {version} by proxy-to-grafana's version.
+func setUserAgent(h http.Header, pattern string) {
+	ua := strings.NewReplacer(
+		"{client}", h.Get("User-Agent"),
+		"{version}", version.Short(),
+	).Replace(pattern)
+	// An empty value, rather than none, stops the reverse proxy from
+	// sending Go's default.
+	h.Set("User-Agent", strings.TrimSpace(ua))
+}
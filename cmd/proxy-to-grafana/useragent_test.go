@@ -0,0 +1,32 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"tailscale.com/version"
+)
+
+func TestUserAgent(t *testing.T) {
+	defer func(v string) { *userAgent = v }(*userAgent)
+	client := http.Header{"User-Agent": {"Mozilla/5.0"}}
+
+	proxyURL, reqs := startProxy(t, fakeWhoIs{})
+	if got := get(t, proxyURL, "/d/abc", reqs, client).Header.Get("User-Agent"); got != "Mozilla/5.0" {
+		t.Errorf("default User-Agent = %q; want the client's", got)
+	}
+
+	for _, tt := range []struct{ pattern, want string }{
+		{"tailscale-grafana-proxy/{version}", "tailscale-grafana-proxy/" + version.Short()},
+		{"{client} via-tailscale", "Mozilla/5.0 via-tailscale"},
+	} {
+		*userAgent = tt.pattern
+		proxyURL, reqs := startProxy(t, fakeWhoIs{})
+		if got := get(t, proxyURL, "/d/abc", reqs, client).Header.Get("User-Agent"); got != tt.want {
+			t.Errorf("--user-agent=%q: User-Agent = %q; want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
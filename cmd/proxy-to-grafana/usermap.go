@@ -0,0 +1,155 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+const (
+	// userMapTimeout bounds how long a single --user-map-url lookup may
+	// take. Users wait for it on /login.
+	userMapTimeout = 5 * time.Second
+
+	// userMapTTL is how long a looked-up Grafana username is reused.
+	userMapTTL = 5 * time.Minute
+)
+
+// userMapResponse is the JSON body returned by --user-map-url.
+type userMapResponse struct {
+	Username string
+}
+
+// userMapper translates Tailscale login names into Grafana usernames by
+// asking an external service, caching its answers for userMapTTL.
+//
+// The service gets a GET request for its URL with the login name in the
+// "login" query parameter, or with --map-by=id, the user ID in the "id"
+// query parameter, and replies with a JSON userMapResponse.
+type userMapper struct {
+	url string
+
+	mu    sync.Mutex
+	cache map[string]userMapEntry // keyed by "login=name" or "id=123"
+}
+
+type userMapEntry struct {
+	username string
+	expires  time.Time
+}
+
+func newUserMapper(mapURL string) *userMapper {
+	return &userMapper{url: mapURL, cache: make(map[string]userMapEntry)}
+}
+
+// userMapKey returns the query parameter with which to look up user: by
+// login name, or with --map-by=id, by its ID, which stays the same when
+// the login name changes. Tagged nodes and --loopback-user have no user
+// ID, so they're always looked up by login name.
+func userMapKey(user *tailcfg.UserProfile) (param, value string) {
+	if *mapBy == "id" && user.ID != 0 {
+		return "id", strconv.FormatInt(int64(user.ID), 10)
+	}
+	return "login", user.LoginName
+}
+
+// lookup returns the Grafana username for user.
+func (m *userMapper) lookup(ctx context.Context, user *tailcfg.UserProfile) (string, error) {
+	param, value := userMapKey(user)
+	key := param + "=" + value
+	now := time.Now()
+	m.mu.Lock()
+	e, ok := m.cache[key]
+	m.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.username, nil
+	}
+
+	username, err := m.fetch(ctx, param, value)
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, e := range m.cache {
+		if now.After(e.expires) {
+			delete(m.cache, k)
+		}
+	}
+	m.cache[key] = userMapEntry{username, now.Add(userMapTTL)}
+	return username, nil
+}
+
+func (m *userMapper) fetch(ctx context.Context, param, value string) (string, error) {
+	u, err := url.Parse(m.url)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set(param, value)
+	u.RawQuery = q.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, userMapTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %v", res.Status)
+	}
+	var mr userMapResponse
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&mr); err != nil {
+		return "", fmt.Errorf("decoding response: %w", err)
+	}
+	if mr.Username == "" {
+		return "", errors.New("empty Username in response")
+	}
+	return mr.Username, nil
+}
+
+// hook returns a RequestHook that runs hooks with the user's login name
+// replaced by their Grafana username. If the username can't be looked
+// up, it uses the login name as is, or with --user-map-deny, rejects the
+// request.
+func (m *userMapper) hook(hooks []RequestHook) RequestHook {
+	return func(r *http.Request, user *tailcfg.UserProfile) error {
+		if user != nil {
+			username, err := m.lookup(r.Context(), user)
+			if err != nil {
+				log.Printf("request %s: user map lookup for %q: %v", getRequestInfo(r.Context()).id, user.LoginName, err)
+				if *userMapDeny {
+					return &HookError{Status: http.StatusServiceUnavailable, Err: errors.New("can't look up Grafana user")}
+				}
+			} else {
+				mapped := *user
+				mapped.LoginName = username
+				user = &mapped
+			}
+		}
+		for _, hook := range hooks {
+			if err := hook(r, user); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
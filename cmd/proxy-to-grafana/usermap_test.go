@@ -0,0 +1,76 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserMap(t *testing.T) {
+	lookups := 0
+	mapSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		if r.URL.Query().Get("login") != "alice@example.com" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(userMapResponse{Username: "asmith"})
+	}))
+	defer mapSrv.Close()
+
+	defer func(u string, d bool) { *userMapURL, *userMapDeny = u, d }(*userMapURL, *userMapDeny)
+	*userMapURL = mapSrv.URL + "/map"
+
+	proxyURL, reqs := startProxy(t, localhostUser("alice@example.com", "Alice Smith"))
+	for i := 0; i < 2; i++ {
+		r := get(t, proxyURL, "/login", reqs, nil)
+		if got := r.Header.Get("X-Webauth-User"); got != "asmith" {
+			t.Errorf("X-Webauth-User = %q; want asmith", got)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("%d lookups; want 1, then cached", lookups)
+	}
+
+	// Unmapped users keep their login name, unless --user-map-deny.
+	proxyURL, reqs = startProxy(t, localhostUser("bob@example.com", "Bob"))
+	r := get(t, proxyURL, "/login", reqs, nil)
+	if got := r.Header.Get("X-Webauth-User"); got != "bob@example.com" {
+		t.Errorf("unmapped X-Webauth-User = %q; want bob@example.com", got)
+	}
+	*userMapDeny = true
+	res, err := http.Get(proxyURL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("unmapped with --user-map-deny: got %v; want 503", res.Status)
+	}
+}
+
+func TestUserMapByID(t *testing.T) {
+	mapSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if q := r.URL.Query(); q.Get("id") != "2" || q.Has("login") {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(userMapResponse{Username: "asmith"})
+	}))
+	defer mapSrv.Close()
+
+	defer func(u, m string) { *userMapURL, *mapBy = u, m }(*userMapURL, *mapBy)
+	*userMapURL = mapSrv.URL + "/map"
+	*mapBy = "id"
+
+	// Alice's login name changed, but her user ID (2) didn't.
+	proxyURL, reqs := startProxy(t, localhostUser("alice@new.example.com", "Alice Smith"))
+	r := get(t, proxyURL, "/login", reqs, nil)
+	if got := r.Header.Get("X-Webauth-User"); got != "asmith" {
+		t.Errorf("X-Webauth-User = %q; want asmith", got)
+	}
+}
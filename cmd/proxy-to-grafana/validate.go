@@ -0,0 +1,256 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// validateFlags reports an error for missing, invalid, or contradictory
+// flags, so that main fails fast with a clear message rather than
+// misbehaving later.
+func validateFlags() error {
+	if *hostname == "" || strings.Contains(*hostname, ".") {
+		return errors.New("missing or invalid --hostname")
+	}
+	if v := *userAgent; v != "" && !httpguts.ValidHeaderFieldValue(v) {
+		return fmt.Errorf("invalid --user-agent %q", v)
+	}
+	if (*backendAddr == "") == (*backendAddrFile == "") {
+		return errors.New("need exactly one of --backend-addr and --backend-addr-file")
+	}
+	if !*useHTTPS {
+		for _, name := range []string{"funnel", "no-http-redirect", "log-tls-sni", "allowed-hosts", "client-cert-header", "tls-session-tickets", "exit-on-cert-failure", "log-tls-info", "tls-info-header"} {
+			if flagIsSet(name) {
+				return fmt.Errorf("--%s requires --use-https", name)
+			}
+		}
+	}
+	if *allowedHosts != "" && *funnel {
+		return errors.New("--allowed-hosts isn't supported with --funnel")
+	}
+	if *logTLSSNI && *funnel {
+		return errors.New("--log-tls-sni isn't supported with --funnel")
+	}
+	if (*logTLSInfo || *tlsInfoHeader != "") && *funnel {
+		return errors.New("--log-tls-info and --tls-info-header aren't supported with --funnel")
+	}
+	if h := *tlsInfoHeader; h != "" && !httpguts.ValidHeaderFieldName(h) {
+		return fmt.Errorf("invalid --tls-info-header %q", h)
+	}
+	if flagIsSet("tls-session-tickets") && *funnel {
+		return errors.New("--tls-session-tickets isn't supported with --funnel")
+	}
+	if *certFailExit < 0 {
+		return errors.New("invalid negative --exit-on-cert-failure")
+	}
+	if *certFailExit != 0 && *funnel {
+		return errors.New("--exit-on-cert-failure isn't supported with --funnel")
+	}
+	if *backendHeaderTimeout < 0 {
+		return errors.New("invalid negative --backend-header-timeout")
+	}
+	if *maxControlSilence < 0 {
+		return errors.New("invalid negative --max-control-silence")
+	}
+	if d := *maxControlSilence; d > 0 && d < backendStatePollInterval {
+		return fmt.Errorf("invalid --max-control-silence %v; must be at least %v, how often contact with control is checked", d, backendStatePollInterval)
+	}
+	if *slowRequestThreshold < 0 {
+		return errors.New("invalid negative --slow-request-threshold")
+	}
+	if *startupTimeout <= 0 {
+		return errors.New("--startup-timeout must be positive")
+	}
+	for name, v := range map[string]int{
+		"backend-max-conns":               *backendMaxConns,
+		"backend-max-idle-conns":          *backendMaxIdle,
+		"backend-max-idle-conns-per-host": *backendIdlePerHost,
+	} {
+		if v < 0 {
+			return fmt.Errorf("invalid negative --%s", name)
+		}
+	}
+	if *idleTimeout <= 0 {
+		return errors.New("--idle-timeout must be positive")
+	}
+	if *maxHeaderBytes < 1 {
+		return fmt.Errorf("invalid --max-header-bytes %d; must be positive", *maxHeaderBytes)
+	}
+	if *clientCertHeader != "" && *funnel {
+		return errors.New("--client-cert-header isn't supported with --funnel")
+	}
+	if (*clientCertHeader == "") != (*clientCAFile == "") {
+		return errors.New("--client-cert-header and --client-ca-file must be used together")
+	}
+	if _, err := parsePathPatterns(*denyPaths); err != nil {
+		return fmt.Errorf("invalid --deny-paths: %w", err)
+	}
+	if _, err := parsePathPatterns(*noAuthPaths); err != nil {
+		return fmt.Errorf("invalid --no-auth-paths: %w", err)
+	}
+	if *noAuthPaths != "" && *identityStyleName == "grafana" {
+		return errors.New("--no-auth-paths has no effect with --identity-style=grafana, which only identifies /login")
+	}
+	if *grpcBackendAddr != "" && *funnel {
+		return errors.New("--grpc-backend-addr isn't supported with --funnel")
+	}
+	if v := *backendProxyProtocol; v != 0 && v != 1 && v != 2 {
+		return fmt.Errorf("invalid --backend-proxy-protocol %d; want 0, 1 or 2", v)
+	}
+	if *perUserRPS < 0 {
+		return errors.New("invalid negative --per-user-rps")
+	}
+	if *perUserRPS == 0 && flagIsSet("per-user-burst") {
+		return errors.New("--per-user-burst requires --per-user-rps")
+	}
+	if *perUserRPS > 0 && *perUserBurst < 1 {
+		return fmt.Errorf("invalid --per-user-burst %d; must be at least 1", *perUserBurst)
+	}
+	if *cacheStatic < 0 {
+		return errors.New("invalid negative --cache-static")
+	}
+	if *whoIsConcurrency < 0 {
+		return errors.New("invalid negative --whois-concurrency")
+	}
+	if p := *debugPort; p < 0 || p > 65535 || p == 80 || p == 443 {
+		return fmt.Errorf("invalid --debug-port %d; must be a free port other than 80 and 443", p)
+	}
+	if *adminUsers != "" && *debugPort == 0 {
+		return errors.New("--admin-users requires --debug-port")
+	}
+	if *debugTailnet && *debugPort == 0 {
+		return errors.New("--debug-tailnet requires --debug-port")
+	}
+	if *debugTailnet != (*adminUsers != "") {
+		// On localhost, WhoIs can't identify anyone, so --admin-users
+		// would lock everyone out; on the tailnet, it's what keeps
+		// peers out.
+		return errors.New("--debug-tailnet and --admin-users must be used together")
+	}
+	if _, err := parseConnectTargets(*allowConnect); err != nil {
+		return fmt.Errorf("invalid --allow-connect: %w", err)
+	}
+	if *backendDialAddr != "" {
+		if _, _, err := net.SplitHostPort(*backendDialAddr); err != nil {
+			return fmt.Errorf("invalid --backend-dial-addr: %w", err)
+		}
+	}
+	if h := *tailnetHeader; h != "" && !httpguts.ValidHeaderFieldName(h) {
+		return fmt.Errorf("invalid --tailnet-header %q", h)
+	}
+	if h := *nodeIDHeader; h != "" && !httpguts.ValidHeaderFieldName(h) {
+		return fmt.Errorf("invalid --node-id-header %q", h)
+	}
+	if (*jwtHeader == "") != (*jwtKeyFile == "") {
+		return errors.New("--jwt-header and --jwt-key-file must be used together")
+	}
+	if h := *jwtHeader; h != "" && !httpguts.ValidHeaderFieldName(h) {
+		return fmt.Errorf("invalid --jwt-header %q", h)
+	}
+	if *userMapDeny && *userMapURL == "" {
+		return errors.New("--user-map-deny requires --user-map-url")
+	}
+	switch *sanitizeMode {
+	case "encode", "replace", "strip", "reject":
+	default:
+		return fmt.Errorf("invalid --username-sanitize %q; want encode, reject, replace or strip", *sanitizeMode)
+	}
+	if *mapBy != "login" && *mapBy != "id" {
+		return fmt.Errorf("invalid --map-by %q; want login or id", *mapBy)
+	}
+	if flagIsSet("map-by") && *userMapURL == "" {
+		return errors.New("--map-by requires --user-map-url")
+	}
+	if v := *minClientVersion; v != "" && (strings.Trim(v, "0123456789.") != "" || strings.Contains(v, "..")) {
+		return fmt.Errorf("invalid --min-client-version %q; want a version like 1.38.0", v)
+	}
+	if _, err := currentIdentityStyle(); err != nil {
+		return err
+	}
+	if *nameTemplate != "" {
+		if _, err := parseNameTemplate(*nameTemplate); err != nil {
+			return fmt.Errorf("invalid --name-template: %w", err)
+		}
+		if s, _ := currentIdentityStyle(); s.name == "" {
+			return fmt.Errorf("--name-template has no effect with --identity-style=%s, which sends no display name", *identityStyleName)
+		}
+	}
+	if *identityStyleName != "custom" && *identityHeaderPrefix != "" {
+		return errors.New("--identity-header-prefix requires --identity-style=custom")
+	}
+	if _, err := parsePrefixList(*trustedProxies); err != nil {
+		return fmt.Errorf("invalid --trusted-proxies: %w", err)
+	}
+	if *rendererAddr != "" {
+		if _, _, err := net.SplitHostPort(*rendererAddr); err != nil {
+			return fmt.Errorf("invalid --renderer-addr: %w", err)
+		}
+		if _, err := parsePathPatterns(*rendererPath); err != nil || *rendererPath == "" {
+			return fmt.Errorf("invalid --renderer-path %q", *rendererPath)
+		}
+	} else if flagIsSet("renderer-path") || flagIsSet("renderer-header-timeout") {
+		return errors.New("--renderer-path and --renderer-header-timeout require --renderer-addr")
+	}
+	if *rendererTimeout < 0 {
+		return errors.New("invalid negative --renderer-header-timeout")
+	}
+	if *allowOverride && *funnel {
+		return errors.New("--allow-identity-override isn't supported with --funnel")
+	}
+	if *allowOverride && *trustedProxies == "" {
+		return errors.New("--allow-identity-override requires --trusted-proxies")
+	}
+	if *syslogAddr != "" && !*syslogOut {
+		return errors.New("--syslog-addr requires --syslog")
+	}
+	if *localAddr != "" {
+		host, _, err := net.SplitHostPort(*localAddr)
+		if err != nil {
+			return fmt.Errorf("invalid --local-addr: %w", err)
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("invalid --local-addr %q; want a loopback address", *localAddr)
+		}
+	} else if *loopbackUser != "" {
+		return errors.New("--loopback-user requires --local-addr")
+	}
+	if v := *loopbackUser; v != "" && (strings.TrimSpace(v) != v || !httpguts.ValidHeaderFieldValue(v)) {
+		return fmt.Errorf("invalid --loopback-user %q", v)
+	}
+	switch *sharedPolicy {
+	case "allow", "deny", "tag":
+	default:
+		return fmt.Errorf("invalid --shared-node-policy %q; want allow, deny or tag", *sharedPolicy)
+	}
+	switch *taggedPolicy {
+	case "forward", "map":
+	case "deny":
+		if *allowTagged {
+			return errors.New("--allow-tagged conflicts with --tagged-node-policy=deny")
+		}
+	default:
+		return fmt.Errorf("invalid --tagged-node-policy %q; want forward, deny or map", *taggedPolicy)
+	}
+	if !mapTagged() && flagIsSet("tagged-user-pattern") {
+		return errors.New("--tagged-user-pattern requires --allow-tagged or --tagged-node-policy=map")
+	}
+	if strings.TrimSpace(*taggedUserPattern) == "" {
+		return errors.New("invalid empty --tagged-user-pattern")
+	}
+	return nil
+}
+
+// flagIsSet reports whether the named flag is set to something other
+// than its default.
+func flagIsSet(name string) bool {
+	f := flag.Lookup(name)
+	return f != nil && f.Value.String() != f.DefValue
+}
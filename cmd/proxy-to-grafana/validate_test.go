@@ -0,0 +1,163 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+// setFlags parses args into the global flag set for the duration of the
+// test, restoring every flag to its previous value afterwards.
+func setFlags(t *testing.T, args ...string) {
+	t.Helper()
+	old := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		old[f.Name] = f.Value.String()
+	})
+	t.Cleanup(func() {
+		flag.VisitAll(func(f *flag.Flag) {
+			f.Value.Set(old[f.Name])
+		})
+	})
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateFlags(t *testing.T) {
+	base := []string{"--hostname=grafana", "--backend-addr=localhost:3000"}
+	tests := []struct {
+		args    []string
+		wantErr string // substring; empty means valid
+	}{
+		{args: nil},
+		{args: []string{"--use-https", "--funnel", "--no-http-redirect"}},
+		{args: []string{"--use-https", "--log-tls-sni"}},
+		{args: []string{"--use-https", "--allowed-hosts=grafana.example.ts.net"}},
+		{args: []string{"--per-user-rps=5", "--per-user-burst=10"}},
+		{args: []string{"--allow-tagged", "--tagged-user-pattern={node}@example.com"}},
+		{args: []string{"--backend-proxy-protocol=2"}},
+		{args: []string{"--allow-connect=db.example.com:5432, metrics.example.com:443"}},
+		{args: []string{"--jwt-header=X-JWT-Assertion", "--jwt-key-file=key.pem"}},
+		{args: []string{"--min-client-version=1.38.0"}},
+		{args: []string{"--identity-style=oauth2-proxy"}},
+		{args: []string{"--renderer-addr=localhost:8081", "--renderer-header-timeout=2m"}},
+		{args: []string{"--trusted-proxies=100.100.1.2, fd7a:115c:a1e0::/48"}},
+		{args: []string{"--identity-style=custom", "--identity-header-prefix=X-Auth-Request-"}},
+		{args: []string{"--grpc-backend-addr=localhost:9000"}},
+		{args: []string{"--backend-addr=", "--backend-addr-file=backend.txt"}},
+		{args: []string{"--use-https", "--client-cert-header=X-Client-Cert", "--client-ca-file=ca.pem"}},
+		{args: []string{"--local-addr=127.0.0.1:8080", "--loopback-user=healthcheck@example.com"}},
+		{args: []string{"--local-addr=[::1]:8080"}},
+		{args: []string{"--use-https", "--tls-session-tickets=false"}},
+		{args: []string{"--use-https", "--exit-on-cert-failure=5"}},
+		{args: []string{"--user-map-url=https://users.example.com/map", "--map-by=id"}},
+		{args: []string{"--username-sanitize=reject"}},
+		{args: []string{"--username-sanitize=encode"}},
+		{args: []string{"--max-control-silence=1h"}},
+		{args: []string{"--debug-port=8080"}},
+		{args: []string{"--debug-port=8080", "--debug-tailnet", "--admin-users=alice@example.com, bob@example.com"}},
+		{args: []string{"--allow-identity-override", "--trusted-proxies=10.0.0.2"}},
+		{args: []string{"--identity-style=oauth2-proxy", "--no-auth-paths=/public, /favicon.ico"}},
+		{args: []string{"--node-id-header=X-Tailscale-Node-ID"}},
+		{args: []string{"--tagged-node-policy=map", "--tagged-user-pattern=kiosk@example.com"}},
+		{args: []string{"--tagged-node-policy=deny"}},
+		{args: []string{"--shared-node-policy=tag"}},
+		{args: []string{"--quiet"}},
+		{args: []string{"--no-tsnet-logs"}},
+		{args: []string{"--user-agent=tailscale-grafana-proxy/{version} {client}"}},
+		{args: []string{"--use-https", "--log-tls-info", "--tls-info-header=X-TLS-Info"}},
+		{args: []string{"--name-template={{.User.DisplayName}} ({{.Tailnet}})"}},
+
+		{args: []string{"--hostname="}, wantErr: "--hostname"},
+		{args: []string{"--hostname=grafana.example.com"}, wantErr: "--hostname"},
+		{args: []string{"--backend-addr="}, wantErr: "--backend-addr"},
+		{args: []string{"--backend-addr-file=backend.txt"}, wantErr: "exactly one of --backend-addr and --backend-addr-file"},
+		{args: []string{"--funnel"}, wantErr: "--funnel requires --use-https"},
+		{args: []string{"--allowed-hosts=grafana.example.ts.net"}, wantErr: "--allowed-hosts requires --use-https"},
+		{args: []string{"--use-https", "--funnel", "--allowed-hosts=grafana.example.ts.net"}, wantErr: "--allowed-hosts isn't supported with --funnel"},
+		{args: []string{"--no-http-redirect"}, wantErr: "--no-http-redirect requires --use-https"},
+		{args: []string{"--log-tls-sni"}, wantErr: "--log-tls-sni requires --use-https"},
+		{args: []string{"--use-https", "--funnel", "--log-tls-sni"}, wantErr: "--log-tls-sni isn't supported with --funnel"},
+		{args: []string{"--use-https", "--funnel", "--grpc-backend-addr=localhost:9000"}, wantErr: "--grpc-backend-addr isn't supported with --funnel"},
+		{args: []string{"--client-cert-header=X-Client-Cert"}, wantErr: "--client-cert-header requires --use-https"},
+		{args: []string{"--use-https", "--client-cert-header=X-Client-Cert"}, wantErr: "must be used together"},
+		{args: []string{"--use-https", "--client-ca-file=ca.pem"}, wantErr: "must be used together"},
+		{args: []string{"--deny-paths=admin"}, wantErr: "--deny-paths"},
+		{args: []string{"--backend-proxy-protocol=3"}, wantErr: "--backend-proxy-protocol"},
+		{args: []string{"--per-user-rps=-1"}, wantErr: "--per-user-rps"},
+		{args: []string{"--per-user-burst=10"}, wantErr: "--per-user-burst requires --per-user-rps"},
+		{args: []string{"--per-user-rps=5", "--per-user-burst=0"}, wantErr: "--per-user-burst"},
+		{args: []string{"--slow-request-threshold=-1s"}, wantErr: "--slow-request-threshold"},
+		{args: []string{"--backend-max-conns=-1"}, wantErr: "--backend-max-conns"},
+		{args: []string{"--idle-timeout=0"}, wantErr: "--idle-timeout"},
+		{args: []string{"--startup-timeout=0"}, wantErr: "--startup-timeout"},
+		{args: []string{"--cache-static=-1"}, wantErr: "--cache-static"},
+		{args: []string{"--whois-concurrency=-1"}, wantErr: "--whois-concurrency"},
+		{args: []string{"--debug-port=443"}, wantErr: "--debug-port"},
+		{args: []string{"--allow-connect=db.example.com"}, wantErr: "--allow-connect"},
+		{args: []string{"--tailnet-header=X Tailnet"}, wantErr: "--tailnet-header"},
+		{args: []string{"--jwt-header=X-JWT-Assertion"}, wantErr: "--jwt-key-file"},
+		{args: []string{"--user-map-deny"}, wantErr: "--user-map-deny requires --user-map-url"},
+		{args: []string{"--map-by=id"}, wantErr: "--map-by requires --user-map-url"},
+		{args: []string{"--username-sanitize=escape"}, wantErr: "--username-sanitize"},
+		{args: []string{"--max-control-silence=-1m"}, wantErr: "--max-control-silence"},
+		{args: []string{"--max-control-silence=10s"}, wantErr: "must be at least 30s"},
+		{args: []string{"--admin-users=alice@example.com"}, wantErr: "--admin-users requires --debug-port"},
+		{args: []string{"--debug-tailnet"}, wantErr: "--debug-tailnet requires --debug-port"},
+		{args: []string{"--debug-port=8080", "--debug-tailnet"}, wantErr: "must be used together"},
+		{args: []string{"--debug-port=8080", "--admin-users=alice@example.com"}, wantErr: "must be used together"},
+		{args: []string{"--use-https", "--funnel", "--allow-identity-override", "--trusted-proxies=10.0.0.2"}, wantErr: "--allow-identity-override isn't supported"},
+		{args: []string{"--allow-identity-override"}, wantErr: "--allow-identity-override requires --trusted-proxies"},
+		{args: []string{"--no-auth-paths=/public"}, wantErr: "--no-auth-paths has no effect"},
+		{args: []string{"--node-id-header=X Node"}, wantErr: "--node-id-header"},
+		{args: []string{"--tagged-node-policy=ignore"}, wantErr: "--tagged-node-policy"},
+		{args: []string{"--shared-node-policy=block"}, wantErr: "--shared-node-policy"},
+		{args: []string{"--user-agent=bad\nagent"}, wantErr: "--user-agent"},
+		{args: []string{"--tls-info-header=X-TLS-Info"}, wantErr: "--tls-info-header requires --use-https"},
+		{args: []string{"--use-https", "--funnel", "--log-tls-info"}, wantErr: "aren't supported with --funnel"},
+		{args: []string{"--name-template={{.User.DisplayName"}, wantErr: "--name-template"},
+		{args: []string{"--name-template={{.User.Email}}"}, wantErr: "--name-template"},
+		{args: []string{"--identity-style=oauth2-proxy", "--name-template={{.Tailnet}}"}, wantErr: "--name-template has no effect"},
+		{args: []string{"--allow-tagged", "--tagged-node-policy=deny"}, wantErr: "conflicts with --tagged-node-policy=deny"},
+		{args: []string{"--identity-style=oauth2-proxy", "--no-auth-paths=public"}, wantErr: "--no-auth-paths"},
+		{args: []string{"--user-map-url=https://users.example.com/map", "--map-by=email"}, wantErr: "--map-by"},
+		{args: []string{"--min-client-version=v1.38"}, wantErr: "--min-client-version"},
+		{args: []string{"--identity-style=saml"}, wantErr: "--identity-style"},
+		{args: []string{"--identity-style=custom"}, wantErr: "--identity-header-prefix"},
+		{args: []string{"--identity-header-prefix=X-Auth-"}, wantErr: "--identity-header-prefix requires --identity-style=custom"},
+		{args: []string{"--trusted-proxies=100.64.0.0/33"}, wantErr: "--trusted-proxies"},
+		{args: []string{"--renderer-path=/render2"}, wantErr: "require --renderer-addr"},
+		{args: []string{"--renderer-addr=localhost:8081", "--renderer-path=render"}, wantErr: "--renderer-path"},
+		{args: []string{"--backend-dial-addr=10.0.0.5"}, wantErr: "--backend-dial-addr"},
+		{args: []string{"--syslog-addr=logs.example.com:514"}, wantErr: "--syslog-addr requires --syslog"},
+		{args: []string{"--tagged-user-pattern={node}@example.com"}, wantErr: "--tagged-user-pattern requires --allow-tagged"},
+		{args: []string{"--allow-tagged", "--tagged-user-pattern="}, wantErr: "invalid empty --tagged-user-pattern"},
+		{args: []string{"--local-addr=127.0.0.1:8080", "--loopback-user= probe"}, wantErr: "--loopback-user"},
+		{args: []string{"--loopback-user=healthcheck"}, wantErr: "--loopback-user requires --local-addr"},
+		{args: []string{"--local-addr=8080"}, wantErr: "invalid --local-addr"},
+		{args: []string{"--local-addr=0.0.0.0:8080"}, wantErr: "want a loopback address"},
+		{args: []string{"--tls-session-tickets=false"}, wantErr: "--tls-session-tickets requires --use-https"},
+		{args: []string{"--use-https", "--funnel", "--tls-session-tickets=false"}, wantErr: "--tls-session-tickets isn't supported"},
+		{args: []string{"--exit-on-cert-failure=5"}, wantErr: "--exit-on-cert-failure requires --use-https"},
+		{args: []string{"--use-https", "--exit-on-cert-failure=-1"}, wantErr: "--exit-on-cert-failure"},
+		{args: []string{"--use-https", "--funnel", "--exit-on-cert-failure=5"}, wantErr: "--exit-on-cert-failure isn't supported"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			setFlags(t, append(base, tt.args...)...)
+			err := validateFlags()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Errorf("no error; want one containing %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Errorf("error %q doesn't contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/syncs"
+)
+
+// whoIsQueueTimeout is how long a WhoIs call waits for one of the
+// --whois-concurrency slots before failing.
+const whoIsQueueTimeout = 5 * time.Second
+
+var (
+	errWhoIsBusy  = errors.New("too many concurrent WhoIs calls")
+	errNoClient   = errors.New("trusted proxy didn't say which client the request is for")
+	errNotTailnet = errors.New("request to --local-addr isn't from the tailnet, and there's no --loopback-user")
+)
+
+// limitedWhoIs is a whoIsClient that allows at most a fixed number of
+// concurrent WhoIs calls to its underlying client, so traffic spikes
+// don't overwhelm the local Tailscale daemon. Callers beyond the limit
+// wait their turn, for up to whoIsQueueTimeout.
+type limitedWhoIs struct {
+	lc  whoIsClient
+	sem syncs.Semaphore
+}
+
+func newLimitedWhoIs(lc whoIsClient, n int) *limitedWhoIs {
+	return &limitedWhoIs{lc: lc, sem: syncs.NewSemaphore(n)}
+}
+
+func (l *limitedWhoIs) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	qctx, cancel := context.WithTimeout(ctx, whoIsQueueTimeout)
+	defer cancel()
+	if !l.sem.AcquireContext(qctx) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errWhoIsBusy
+	}
+	defer l.sem.Release()
+	whoIsInFlight.Add(1)
+	defer whoIsInFlight.Add(-1)
+	return l.lc.WhoIs(ctx, remoteAddr)
+}
+
+// whoIs returns what's known about the node at ipPort: the
+// --allow-identity-override identity, if the request has one; nothing,
+// if it's from a --trusted-proxies proxy that didn't name its client;
+// the --loopback-user one, for requests to --local-addr; or else lc's
+// WhoIs response. Within a request, lc is asked at most once, and the answer
+// is shared by every handler that needs it.
+func whoIs(ctx context.Context, lc whoIsClient, ipPort string) (*apitype.WhoIsResponse, error) {
+	ri := getRequestInfo(ctx)
+	if ri.override != nil {
+		return ri.override, nil
+	}
+	if ri.unidentified {
+		return nil, errNoClient
+	}
+	if isLocalConn(ctx) {
+		if *loopbackUser == "" {
+			return nil, errNotTailnet
+		}
+		return loopbackWhoIs(), nil
+	}
+	if l := ri.lookup; l != nil && l.addr == ipPort {
+		return l.res, l.err
+	}
+	res, err := lc.WhoIs(ctx, ipPort)
+	ri.lookup = &whoIsLookup{addr: ipPort, res: res, err: err}
+	return res, err
+}
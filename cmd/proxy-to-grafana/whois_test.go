@@ -0,0 +1,97 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// blockingWhoIs is a whoIsClient whose calls block until its channel
+// is closed.
+type blockingWhoIs chan struct{}
+
+func (b blockingWhoIs) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	<-b
+	return &apitype.WhoIsResponse{}, nil
+}
+
+// countingWhoIs is a whoIsClient that counts its calls.
+type countingWhoIs struct {
+	whoIsClient
+	calls *atomic.Int32
+}
+
+func (c countingWhoIs) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	c.calls.Add(1)
+	return c.whoIsClient.WhoIs(ctx, remoteAddr)
+}
+
+func TestLimitedWhoIs(t *testing.T) {
+	unblock := make(blockingWhoIs)
+	l := newLimitedWhoIs(unblock, 1)
+
+	errc := make(chan error)
+	go func() {
+		_, err := l.WhoIs(context.Background(), "100.64.0.1:1234")
+		errc <- err
+	}()
+	// Wait for the first call to take the only slot.
+	for whoIsInFlight.Value() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.WhoIs(ctx, "100.64.0.2:1234"); !errors.Is(err, context.Canceled) {
+		t.Errorf("queued WhoIs with canceled context: err = %v; want context.Canceled", err)
+	}
+
+	close(unblock)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if got := whoIsInFlight.Value(); got != 0 {
+		t.Errorf("in-flight count = %d after calls finished; want 0", got)
+	}
+}
+
+func TestWhoIsOncePerRequest(t *testing.T) {
+	defer func(v string) { *identityStyleName = v }(*identityStyleName)
+	defer func(v bool) { *enforceOrg = v }(*enforceOrg)
+	defer func(v bool) { *capHeaders = v }(*capHeaders)
+	defer func(v bool) { *rejectExpired = v }(*rejectExpired)
+	defer func(v string) { *tailnetHeader = v }(*tailnetHeader)
+	defer func(v string) { *nodeIDHeader = v }(*nodeIDHeader)
+	defer func(v string) { *sharedPolicy = v }(*sharedPolicy)
+	defer func(v string) { *minClientVersion = v }(*minClientVersion)
+	defer func(v float64) { *perUserRPS = v }(*perUserRPS)
+	*identityStyleName = "oauth2-proxy" // identifies every request
+	*enforceOrg = true
+	*capHeaders = true
+	*rejectExpired = true
+	*tailnetHeader = "X-Tailnet"
+	*nodeIDHeader = "X-Node-Id"
+	*sharedPolicy = "tag"
+	*minClientVersion = "1.38.0"
+	*perUserRPS = 100
+
+	var calls atomic.Int32
+	lc := countingWhoIs{localhostUser("alice@example.com", "Alice"), &calls}
+	proxyURL, reqs := startProxy(t, lc)
+	for i := 1; i <= 2; i++ {
+		r := get(t, proxyURL, "/d/abc", reqs, nil)
+		if got := r.Header.Get("X-Forwarded-User"); got != "alice@example.com" {
+			t.Errorf("X-Forwarded-User = %q; want alice@example.com", got)
+		}
+		if got := calls.Load(); got != int32(i) {
+			t.Errorf("after %d requests, %d WhoIs calls; want %d", i, got, i)
+		}
+	}
+}
@@ -86,6 +86,12 @@ type Server struct {
 	// log.Printf is used.
 	Logf logger.Logf
 
+	// UserLogf, if non-nil, specifies the logger to use for logs the
+	// user should see, such as the URL to visit to authenticate the
+	// node. It lets Logf discard or divert verbose internal logs
+	// without hiding those. By default, messages go to Logf.
+	UserLogf logger.Logf
+
 	// Ephemeral, if true, specifies that the instance should register
 	// as an Ephemeral node (https://tailscale.com/s/ephemeral-nodes).
 	Ephemeral bool
@@ -651,6 +657,19 @@ func (s *Server) logf(format string, a ...interface{}) {
 	log.Printf(format, a...)
 }
 
+// userLogf logs a message the user should see, to s.UserLogf if set
+// and otherwise like s.logf.
+func (s *Server) userLogf(format string, a ...interface{}) {
+	if s.UserLogf == nil {
+		s.logf(format, a...)
+		return
+	}
+	if s.logtail != nil {
+		s.logtail.Logf(format, a...)
+	}
+	s.UserLogf(format, a...)
+}
+
 // ReplaceGlobalLoggers will replace any Tailscale-specific package-global
 // loggers with this Server's logger. It returns a function that, when called,
 // will undo any changes made.
@@ -683,7 +702,7 @@ func (s *Server) printAuthURLLoop() {
 		}
 		st := s.lb.StatusWithoutPeers()
 		if st.AuthURL != "" {
-			s.logf("To start this tsnet server, restart with TS_AUTHKEY set, or go to: %s", st.AuthURL)
+			s.userLogf("To start this tsnet server, restart with TS_AUTHKEY set, or go to: %s", st.AuthURL)
 		}
 		select {
 		case <-time.After(5 * time.Second):